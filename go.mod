@@ -4,17 +4,25 @@ go 1.18
 
 require (
 	github.com/Masterminds/semver/v3 v3.2.1
+	github.com/alicebob/miniredis/v2 v2.30.4
 	github.com/evanw/esbuild v0.20.0
 	github.com/ije/esbuild-internal v0.20.0
 	github.com/ije/gox v0.6.1
 	github.com/ije/rex v1.10.11
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/mssola/useragent v1.0.0
+	github.com/redis/go-redis/v9 v9.0.5
 	go.etcd.io/bbolt v1.3.8
 )
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/andybalholm/brotli v1.0.6 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/rs/cors v1.10.1 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
 	golang.org/x/crypto v0.16.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
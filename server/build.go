@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -27,6 +28,7 @@ type ESMBuild struct {
 	TypesOnly        bool     `json:"o,omitempty"`
 	PackageCSS       bool     `json:"s,omitempty"`
 	Deps             []string `json:"p,omitempty"`
+	Checksum         string   `json:"h,omitempty"`
 }
 
 type BuildTask struct {
@@ -39,10 +41,17 @@ type BuildTask struct {
 	BundleDeps   bool
 	NoBundle     bool
 	Deprecated   string
+	// the depth of the deps to prefetch after the build is done
+	Prefetch int
 	// internal
 	lock        sync.Mutex
+	ctx         context.Context
 	id          string
+	stageLock   sync.RWMutex // guards the stage, it's read by the queue and the worker heartbeat
 	stage       string
+	stageAt     time.Time
+	onStage     func(stage string)
+	traceparent string
 	wd          string
 	realWd      string
 	installDir  string
@@ -57,7 +66,7 @@ func (task *BuildTask) Build() (esm *ESMBuild, err error) {
 	// check request package
 	if !task.Pkg.FromEsmsh && !task.Pkg.FromGithub {
 		var p NpmPackageInfo
-		p, _, err = getPackageInfo("", task.Pkg.Name, task.Pkg.Version)
+		p, _, err = getPackageInfoContext(task.context(), "", task.Pkg.Name, task.Pkg.Version)
 		if err != nil {
 			return
 		}
@@ -112,9 +121,9 @@ func (task *BuildTask) Build() (esm *ESMBuild, err error) {
 		}
 	}
 
-	task.stage = "install"
+	task.setStage("install")
 
-	err = installPackage(task.wd, task.Pkg)
+	err = task.installPackage(task.wd, task.Pkg)
 	if err != nil {
 		return
 	}
@@ -135,7 +144,12 @@ func (task *BuildTask) Build() (esm *ESMBuild, err error) {
 		return
 	}
 
-	task.stage = "build"
+	err = task.context().Err()
+	if err != nil {
+		return
+	}
+
+	task.setStage("build")
 	err = task.build()
 	if err != nil {
 		return
@@ -154,14 +168,13 @@ func (task *BuildTask) build() (err error) {
 			if err != nil {
 				return err
 			}
-			buffer := bytes.NewBufferString("export default ")
-			buffer.Write(json)
-			_, err = fs.WriteFile(task.getSavepath(), buffer)
+			checksum, err := task.writeBuildFile(concatBytes([]byte("export default "), json))
 			if err != nil {
 				return err
 			}
 			task.esm = &ESMBuild{
 				HasExportDefault: true,
+				Checksum:         checksum,
 			}
 			task.storeToDB()
 			return nil
@@ -204,10 +217,11 @@ func (task *BuildTask) build() (err error) {
 			Pkg:    pkg,
 			Target: task.Target,
 			Dev:    task.Dev,
+			ctx:    task.ctx,
 			wd:     task.installDir,
 		}
 		if !formJson {
-			err = installPackage(task.wd, t.Pkg)
+			err = task.installPackage(task.wd, t.Pkg)
 			if err != nil {
 				return
 			}
@@ -226,7 +240,7 @@ func (task *BuildTask) build() (err error) {
 			fmt.Fprintf(buf, `export { default } from "%s";`, importPath)
 		}
 
-		_, err = fs.WriteFile(task.getSavepath(), buf)
+		esm.Checksum, err = task.writeBuildFile(buf.Bytes())
 		if err != nil {
 			return
 		}
@@ -713,8 +727,14 @@ rebuild:
 	} else if entryPoint != "" {
 		options.EntryPoints = []string{entryPoint}
 	}
-	result := api.Build(options)
+	result := esbuild(task.context(), options)
+	if err = task.context().Err(); err != nil {
+		return
+	}
 	if len(result.Errors) > 0 {
+		for _, e := range result.Errors {
+			getBuildLog(task.context()).Printf("error", "esbuild: %s", formatEsbuildMessage(e))
+		}
 		// mark the missing module as external to exclude it from the bundle
 		msg := result.Errors[0].Text
 		if strings.HasPrefix(msg, "Could not resolve \"") {
@@ -726,6 +746,7 @@ rebuild:
 			name := strings.Split(msg, "\"")[1]
 			if !implicitExternal.Has(name) {
 				log.Warnf("build(%s): implicit external '%s'", task.ID(), name)
+				getBuildLog(task.context()).Printf("warn", "implicit external '%s', rebuilding", name)
 				implicitExternal.Add(name)
 				goto rebuild
 			}
@@ -756,6 +777,7 @@ rebuild:
 		if strings.HasPrefix(w.Text, "Could not resolve \"") {
 			log.Warnf("esbuild(%s): %s", task.ID(), w.Text)
 		}
+		getBuildLog(task.context()).Printf("warn", "esbuild: %s", formatEsbuildMessage(w))
 	}
 
 	for _, file := range result.OutputFiles {
@@ -877,10 +899,11 @@ rebuild:
 									Pkg:    pkg,
 									Target: task.Target,
 									Dev:    task.Dev,
+									ctx:    task.ctx,
 									wd:     task.installDir,
 								}
 								if !formJson {
-									e = installPackage(task.wd, t.Pkg)
+									e = task.installPackage(task.wd, t.Pkg)
 								}
 								if e == nil {
 									m, _, _, e := t.analyze(true)
@@ -927,7 +950,7 @@ rebuild:
 			finalContent.WriteString(filepath.Base(task.ID()))
 			finalContent.WriteString(".map")
 
-			_, err = fs.WriteFile(task.getSavepath(), finalContent)
+			esm.Checksum, err = task.writeBuildFile(finalContent.Bytes())
 			if err != nil {
 				return
 			}
@@ -937,7 +960,7 @@ rebuild:
 	for _, file := range result.OutputFiles {
 		if strings.HasSuffix(file.Path, ".css") {
 			savePath := task.getSavepath()
-			_, err = fs.WriteFile(strings.TrimSuffix(savePath, path.Ext(savePath))+".css", bytes.NewReader(file.Contents))
+			_, err = writeStorageFile(task.context(), strings.TrimSuffix(savePath, path.Ext(savePath))+".css", bytes.NewReader(file.Contents))
 			if err != nil {
 				return
 			}
@@ -955,7 +978,7 @@ rebuild:
 				}
 				buf := bytes.NewBuffer(nil)
 				if json.NewEncoder(buf).Encode(sourceMap) == nil {
-					_, err = fs.WriteFile(task.getSavepath()+".map", buf)
+					_, err = writeStorageFile(task.context(), task.getSavepath()+".map", buf)
 					if err != nil {
 						return
 					}
@@ -1168,8 +1191,21 @@ func (task *BuildTask) checkDTS() {
 
 func (task *BuildTask) buildDTS(dts string) {
 	start := time.Now()
-	task.stage = "transform-dts"
-	n, err := task.TransformDTS(dts)
+	task.setStage("transform-dts")
+
+	ctx := task.context()
+	timeout := time.Duration(getBuildTimeouts(task.Pkg.Name).DTS)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	n, err := task.TransformDTS(ctx, dts)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		getBuildLog(ctx).Printf("warn", "transform dts '%s': timeout(%v)", dts, timeout)
+		log.Warnf("TransformDTS(%s): timeout(%v)", dts, timeout)
+		return
+	}
 	if err != nil && os.IsExist(err) {
 		log.Errorf("TransformDTS(%s): %v", dts, err)
 		return
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
+	"path"
 	"sort"
 	"strings"
 
@@ -20,6 +22,64 @@ type BuildArgs struct {
 	keepNames         bool
 }
 
+type buildArgsJSON struct {
+	Alias             map[string]string `json:"alias,omitempty"`
+	Deps              PkgSlice          `json:"deps,omitempty"`
+	Conditions        []string          `json:"conditions,omitempty"`
+	External          []string          `json:"external,omitempty"`
+	Exports           []string          `json:"exports,omitempty"`
+	DenoStdVersion    string            `json:"denoStdVersion,omitempty"`
+	IgnoreAnnotations bool              `json:"ignoreAnnotations,omitempty"`
+	IgnoreRequire     bool              `json:"ignoreRequire,omitempty"`
+	KeepNames         bool              `json:"keepNames,omitempty"`
+}
+
+func (args BuildArgs) MarshalJSON() ([]byte, error) {
+	v := buildArgsJSON{
+		Alias:             args.alias,
+		Deps:              args.deps,
+		DenoStdVersion:    args.denoStdVersion,
+		IgnoreAnnotations: args.ignoreAnnotations,
+		IgnoreRequire:     args.ignoreRequire,
+		KeepNames:         args.keepNames,
+	}
+	if args.conditions != nil {
+		v.Conditions = args.conditions.SortedValues()
+	}
+	if args.external != nil {
+		v.External = args.external.SortedValues()
+	}
+	if args.exports != nil {
+		v.Exports = args.exports.SortedValues()
+	}
+	return json.Marshal(v)
+}
+
+func (args *BuildArgs) UnmarshalJSON(data []byte) error {
+	var v buildArgsJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*args = BuildArgs{
+		alias:             v.Alias,
+		deps:              v.Deps,
+		conditions:        newStringSet(v.Conditions...),
+		external:          newStringSet(v.External...),
+		exports:           newStringSet(v.Exports...),
+		denoStdVersion:    v.DenoStdVersion,
+		ignoreAnnotations: v.IgnoreAnnotations,
+		ignoreRequire:     v.IgnoreRequire,
+		keepNames:         v.KeepNames,
+	}
+	if args.alias == nil {
+		args.alias = map[string]string{}
+	}
+	if args.deps == nil {
+		args.deps = PkgSlice{}
+	}
+	return nil
+}
+
 func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
 	s, err := atobUrl(strings.TrimPrefix(strings.TrimSuffix(raw, "/"), "X-"))
 	if err == nil {
@@ -81,6 +141,73 @@ func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
 	return
 }
 
+// splitBuildArgsPrefix decodes the `X-` prefix of the build path and removes it from the submodule
+// of the package, it returns false if there is no prefix.
+func splitBuildArgsPrefix(pkg *Pkg) (args BuildArgs, ok bool, err error) {
+	a := strings.Split(pkg.SubModule, "/")
+	if len(a) < 2 || !strings.HasPrefix(a[0], "X-") {
+		return
+	}
+	args, err = decodeBuildArgsPrefix(a[0])
+	if err != nil {
+		return
+	}
+	if args.denoStdVersion == "" {
+		// ensure deno/std version used
+		args.denoStdVersion = denoStdVersion
+	}
+	pkg.SubModule = strings.Join(a[1:], "/")
+	pkg.SubPath = strings.Join(strings.Split(pkg.SubPath, "/")[1:], "/")
+	return args, true, nil
+}
+
+// buildPath is the build options in the build path, e.g. `/v135/react@18.2.0/es2022/react.development.mjs`.
+type buildPath struct {
+	target     string
+	submodule  string
+	bundleDeps bool
+	noBundle   bool
+	dev        bool
+}
+
+// parseBuildPath parses the `{target}/{submodule}[.bundle|.bundless][.development]` submodule of the
+// build path, the `X-` prefix should be removed by `splitBuildArgsPrefix` first. It returns false if
+// the submodule doesn't start with a build target.
+func parseBuildPath(pkg Pkg) (p buildPath, ok bool) {
+	a := strings.Split(pkg.SubModule, "/")
+	if targets[a[0]] == 0 {
+		return
+	}
+	p.target = a[0]
+	p.submodule = strings.Join(a[1:], "/")
+	if strings.HasSuffix(p.submodule, ".bundle") {
+		p.submodule = strings.TrimSuffix(p.submodule, ".bundle")
+		p.bundleDeps = true
+	} else if strings.HasSuffix(p.submodule, ".bundless") {
+		p.submodule = strings.TrimSuffix(p.submodule, ".bundless")
+		p.noBundle = true
+	}
+	if strings.HasSuffix(p.submodule, ".development") {
+		p.submodule = strings.TrimSuffix(p.submodule, ".development")
+		p.dev = true
+	}
+	return p, true
+}
+
+// entrySubmodule returns the submodule of the package to build, the main entry of the package
+// (e.g. `react.mjs` of `react`) is an empty submodule.
+func (p buildPath) entrySubmodule(pkg Pkg) string {
+	submodule := p.submodule
+	if strings.HasPrefix(pkg.Name, "~") || (strings.HasSuffix(pkg.SubPath, ".mjs") && submodule == strings.TrimSuffix(path.Base(pkg.Name), ".js")) {
+		submodule = ""
+	}
+	// workaround for es5-ext weird "/#/" path
+	if submodule != "" && pkg.Name == "es5-ext" {
+		submodule = strings.ReplaceAll(submodule, "/$$/", "/#/")
+	}
+	return submodule
+}
+
 func encodeBuildArgsPrefix(args BuildArgs, pkg Pkg, forTypes bool) string {
 	lines := []string{}
 	if !(stableBuild[pkg.Name] && pkg.SubModule == "") {
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"testing"
 )
 
@@ -65,3 +66,87 @@ func TestEncodeBuildArgs(t *testing.T) {
 		t.Fatal("ignoreAnnotations should be true")
 	}
 }
+
+func TestBuildArgsJSON(t *testing.T) {
+	data, err := json.Marshal(BuildArgs{
+		alias:          map[string]string{"a": "b"},
+		deps:           PkgSlice{Pkg{Name: "c", Version: "1.0.0"}},
+		conditions:     newStringSet("react-server"),
+		external:       newStringSet("bar", "baz"),
+		exports:        newStringSet(),
+		denoStdVersion: "0.128.0",
+		keepNames:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var args BuildArgs
+	err = json.Unmarshal(data, &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args.alias) != 1 || args.alias["a"] != "b" {
+		t.Fatal("invalid alias")
+	}
+	if len(args.deps) != 1 || args.deps[0].String() != "c@1.0.0" {
+		t.Fatal("invalid deps")
+	}
+	if args.conditions.Len() != 1 || !args.conditions.Has("react-server") {
+		t.Fatal("invalid conditions")
+	}
+	if args.external.Len() != 2 || !args.external.Has("baz") {
+		t.Fatal("invalid external")
+	}
+	if args.exports.Len() != 0 {
+		t.Fatal("invalid exports")
+	}
+	if args.denoStdVersion != "0.128.0" {
+		t.Fatal("invalid denoStdVersion")
+	}
+	if !args.keepNames || args.ignoreRequire {
+		t.Fatal("invalid flags")
+	}
+}
+
+func TestParseBuildPath(t *testing.T) {
+	for pathname, expected := range map[string]buildPath{
+		"/react@18.2.0/es2022/react.mjs":                         {target: "es2022", submodule: "react"},
+		"/react@18.2.0/es2022/react.development.mjs":             {target: "es2022", submodule: "react", dev: true},
+		"/react-dom@18.2.0/es2022/client.development.bundle.mjs": {target: "es2022", submodule: "client", bundleDeps: true, dev: true},
+		"/react-dom@18.2.0/deno/server.bundless.js":              {target: "deno", submodule: "server", noBundle: true},
+		"/es5-ext@0.10.62/es2022/string/$$/contains.mjs":         {target: "es2022", submodule: "string/$$/contains"},
+		"/react@18.2.0/unknown/react.mjs":                        {},
+	} {
+		pkg, _, err := validatePkgPath(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp, ok := parseBuildPath(pkg)
+		if ok != (expected.target != "") || bp != expected {
+			t.Fatalf("unexpected build path of '%s': %+v", pathname, bp)
+		}
+	}
+
+	pkg, _, _ := validatePkgPath("/react@18.2.0/es2022/react.mjs")
+	if bp, _ := parseBuildPath(pkg); bp.entrySubmodule(pkg) != "" {
+		t.Fatal("the main entry should be an empty submodule")
+	}
+	pkg, _, _ = validatePkgPath("/es5-ext@0.10.62/es2022/string/$$/contains.mjs")
+	if bp, _ := parseBuildPath(pkg); bp.entrySubmodule(pkg) != "string/#/contains" {
+		t.Fatalf("unexpected submodule of es5-ext: %s", bp.entrySubmodule(pkg))
+	}
+
+	args := BuildArgs{alias: map[string]string{"react": "preact/compat"}, deps: PkgSlice{}, external: newStringSet(), exports: newStringSet(), conditions: newStringSet()}
+	prefix := encodeBuildArgsPrefix(args, Pkg{Name: "swr", Version: "2.2.4"}, false)
+	pkg, _, err := validatePkgPath("/swr@2.2.4/" + prefix + "es2022/swr.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, ok, err := splitBuildArgsPrefix(&pkg)
+	if err != nil || !ok || decoded.alias["react"] != "preact/compat" || decoded.denoStdVersion != denoStdVersion {
+		t.Fatalf("unexpected args of the prefix '%s': %+v, %v", prefix, decoded, err)
+	}
+	if pkg.SubModule != "es2022/swr" || pkg.SubPath != "es2022/swr.mjs" {
+		t.Fatalf("the prefix should be removed: %+v", pkg)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+// the types of the build events
+const (
+	buildEventEnqueued = "enqueued"
+	buildEventStarted  = "started"
+	buildEventStage    = "stage"
+	buildEventFinished = "finished"
+	buildEventFailed   = "failed"
+)
+
+// the buffer size of the event channel of a subscriber, the events are dropped
+// if the subscriber can't keep up
+const buildEventsBuffer = 256
+
+// the interval to send the keep-alive comment to the event stream
+const buildEventsKeepAlive = 30 * time.Second
+
+// BuildEvent is an event of the build queue.
+type BuildEvent struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Pkg      string `json:"pkg"`
+	Target   string `json:"target"`
+	Stage    string `json:"stage,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	Worker   string `json:"worker,omitempty"`
+	// the waiting time of the `started` event, or the build time of the `finished`/`failed` events, in milliseconds
+	Duration int64  `json:"duration,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Time     int64  `json:"time"`
+	pkg      Pkg
+}
+
+// Subscribe subscribes the events of the queue, the unsubscribe function must be called
+// when the subscriber is gone.
+func (q *BuildQueue) Subscribe() (events <-chan BuildEvent, unsubscribe func()) {
+	c := make(chan BuildEvent, buildEventsBuffer)
+	q.eventsLock.Lock()
+	q.subscribers[c] = struct{}{}
+	q.eventsLock.Unlock()
+	return c, func() {
+		q.eventsLock.Lock()
+		delete(q.subscribers, c)
+		q.eventsLock.Unlock()
+	}
+}
+
+// emit sends the event of the task to the subscribers, it never blocks.
+func (q *BuildQueue) emit(t *queueTask, event BuildEvent) {
+	q.eventsLock.RLock()
+	defer q.eventsLock.RUnlock()
+
+	if len(q.subscribers) == 0 {
+		return
+	}
+	event.ID = t.ID()
+	event.Pkg = t.Pkg.String()
+	event.pkg = t.Pkg
+	event.Target = t.Target
+	event.Time = time.Now().UnixMilli()
+	for c := range q.subscribers {
+		select {
+		case c <- event:
+		default:
+		}
+	}
+}
+
+// buildEventsHandler streams the events of the build queue as server-sent events, the events can be
+// filtered by the `?pkg=react,react-dom@18.2.0` or `?id={buildId}` query.
+func buildEventsHandler(ctx *rex.Context) interface{} {
+	pkgs := newStringSet()
+	ids := newStringSet()
+	for _, p := range strings.Split(ctx.Form.Value("pkg"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			pkgs.Add(p)
+		}
+	}
+	for _, p := range strings.Split(ctx.Form.Value("id"), ",") {
+		if p = strings.TrimPrefix(strings.TrimSpace(p), "/"); p != "" {
+			ids.Add(p)
+		}
+	}
+	match := func(event BuildEvent) bool {
+		if ids.Len() > 0 && !ids.Has(event.ID) {
+			return false
+		}
+		if pkgs.Len() > 0 && !pkgs.Has(event.pkg.Name) && !pkgs.Has(event.pkg.VersionName()) {
+			return false
+		}
+		return true
+	}
+
+	flusher, ok := ctx.W.(http.Flusher)
+	if !ok {
+		return rex.Status(500, "streaming is not supported")
+	}
+	events, unsubscribe := buildQueue.Subscribe()
+	defer unsubscribe()
+
+	header := ctx.W.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	header.Set("X-Accel-Buffering", "no")
+	ctx.W.WriteHeader(200)
+	fmt.Fprintf(ctx.W, "retry: %d\n\n", 3000)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(buildEventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.R.Context().Done():
+			return []byte{}
+		case <-keepAlive.C:
+			fmt.Fprint(ctx.W, ": keep-alive\n\n")
+		case event := <-events:
+			if !match(event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(ctx.W, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
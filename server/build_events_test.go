@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestBuildEvents(t *testing.T) {
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+	events, unsubscribe := q.Subscribe()
+
+	next := func(expected string) BuildEvent {
+		select {
+		case event := <-events:
+			if event.Type != expected {
+				t.Fatalf("expected '%s' event, got '%s'", expected, event.Type)
+			}
+			if event.ID != "foo" || event.Pkg != "foo@1.0.0" || event.Target != "es2022" || event.Time == 0 {
+				t.Fatalf("unexpected event: %+v", event)
+			}
+			return event
+		case <-time.After(time.Second):
+			t.Fatalf("expected '%s' event", expected)
+		}
+		return BuildEvent{}
+	}
+
+	task := &BuildTask{Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022", id: "foo"}
+	q.Add(task, BuildClient{IP: "1.1.1.1"})
+	if event := next(buildEventEnqueued); event.Priority != "interactive" {
+		t.Fatalf("unexpected priority: %s", event.Priority)
+	}
+
+	task.setStage("install")
+	if event := next(buildEventStage); event.Stage != "install" {
+		t.Fatalf("unexpected stage: %s", event.Stage)
+	}
+
+	q.lock.Lock()
+	qt := q.tasks["foo"]
+	qt.startedAt = time.Now().Add(-time.Second)
+	q.lock.Unlock()
+	q.finish(qt, BuildOutput{err: errors.New("oops")})
+	if event := next(buildEventFailed); event.Error != "oops" || event.Duration < 1000 {
+		t.Fatalf("unexpected failed event: %+v", event)
+	}
+
+	unsubscribe()
+	q.Add(task, BuildClient{})
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event after unsubscribed: %+v", event)
+	default:
+	}
+}
+
+func TestBuildEventsCancelPending(t *testing.T) {
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+	events, unsubscribe := q.Subscribe()
+	defer unsubscribe()
+
+	task := &BuildTask{Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022", id: "foo"}
+	c, _ := q.Add(task, BuildClient{IP: "1.1.1.1"})
+	<-events
+
+	// the abandoned pending task is cancelled with the terminal event
+	q.RemoveConsumer(task, c)
+	select {
+	case event := <-events:
+		if event.Type != buildEventFailed || event.Error != "context canceled" {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the failed event of the cancelled task")
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+// the backoff of the retries of a failed build, it's doubled on every failure
+const (
+	failureBackoffMin = time.Minute
+	failureBackoffMax = 24 * time.Hour
+	// the max backoff of the transient failures (e.g. the timeouts, the network errors)
+	failureTransientBackoffMax = 5 * time.Minute
+)
+
+// the patterns of the transient errors, they are only used to classify the errors reported by the
+// remote workers that don't flag the transient errors
+var transientErrorPatterns = []string{
+	"timeout(",
+	"i/o timeout",
+	"deadline exceeded",
+	"connection refused",
+	"connection reset",
+	"no such host",
+	"unexpected EOF",
+	"TLS handshake",
+	"ECONNRESET",
+	"ETIMEDOUT",
+	"EAI_AGAIN",
+	"ERR_PNPM_FETCH",
+	"ERR_PNPM_META_FETCH_FAIL",
+	"429 Too Many Requests",
+	"500 Internal Server Error",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+	"interrupted by the server shutdown",
+}
+
+// buildFailure is the record of a failed build, it's stored in the db with the `failure-` key
+// prefix. The build is not retried until the retry time to avoid rebuilding the broken packages
+// on every request.
+type buildFailure struct {
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	FailedAt int64  `json:"failedAt"`
+	RetryAt  int64  `json:"retryAt"`
+}
+
+func (f *buildFailure) Err() error {
+	return errors.New(f.Error)
+}
+
+// getBuildFailure returns the failure record of the build if it's in the backoff window.
+func getBuildFailure(id string) (*buildFailure, bool) {
+	f, err := loadBuildFailure(id)
+	if err != nil || f == nil || time.Now().Unix() >= f.RetryAt {
+		return nil, false
+	}
+	return f, true
+}
+
+func loadBuildFailure(id string) (*buildFailure, error) {
+	value, err := db.Get("failure-" + id)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var f buildFailure
+	if json.Unmarshal(value, &f) != nil {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+// recordBuildFailure records the failure of the build with the exponential backoff, the backoff of
+// the transient failures is capped by `failureTransientBackoffMax`.
+func recordBuildFailure(id string, buildErr error) {
+	// the cancelled build will be retried on demand
+	if isCanceled(buildErr) {
+		return
+	}
+	f, err := loadBuildFailure(id)
+	if err != nil {
+		log.Warnf("db: %v", err)
+		return
+	}
+	if f == nil {
+		f = &buildFailure{}
+	}
+	f.Attempts++
+	f.Error = buildErr.Error()
+	f.FailedAt = time.Now().Unix()
+	backoff := failureBackoff(f.Attempts)
+	if isTransientError(buildErr) && backoff > failureTransientBackoffMax {
+		backoff = failureTransientBackoffMax
+	}
+	f.RetryAt = time.Now().Add(backoff).Unix()
+	if err := db.Put("failure-"+id, utils.MustEncodeJSON(f)); err != nil {
+		log.Warnf("db: %v", err)
+	}
+}
+
+// clearBuildFailure removes the failure record of the build, it returns false if there is no record.
+func clearBuildFailure(id string) (ok bool, err error) {
+	f, err := loadBuildFailure(id)
+	if err != nil || f == nil {
+		return
+	}
+	return true, db.Delete("failure-" + id)
+}
+
+// clearBuildFailures removes all the failure records, it returns the number of removed records.
+func clearBuildFailures() (n int, err error) {
+	keys, err := db.List("failure-")
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if err = db.Delete(key); err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
+
+// failureBackoff returns the backoff of the attempts: 1m, 2m, 4m, ..., 24h.
+func failureBackoff(attempts int) time.Duration {
+	backoff := failureBackoffMin
+	for i := 1; i < attempts && backoff < failureBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > failureBackoffMax {
+		backoff = failureBackoffMax
+	}
+	return backoff
+}
+
+// transientError is the error that is transient, e.g. a timeout or a network error of the npm
+// registry, the build may succeed if it's retried later.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+// asTransientError marks the error as transient.
+func asTransientError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &transientError{err}
+}
+
+// isTransientError checks if the error is transient, the error is transient if it's marked by
+// `asTransientError`, or it's a timeout or a network error.
+func isTransientError(err error) bool {
+	var transientErr *transientError
+	if errors.As(err, &transientErr) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isTransientErrorText checks if the error text reported by a remote worker is transient, it's the
+// fallback of the workers that don't report the transient flag.
+func isTransientErrorText(msg string) bool {
+	for _, pattern := range transientErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCanceled checks if the error is caused by the cancellation, the error may be reported by a
+// remote worker as text.
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || err.Error() == context.Canceled.Error()
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFailureBackoff(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		5:  16 * time.Minute,
+		12: 24 * time.Hour,
+		99: 24 * time.Hour,
+	} {
+		if backoff := failureBackoff(attempts); backoff != expected {
+			t.Fatalf("expected backoff of %d attempts to be %v, got %v", attempts, expected, backoff)
+		}
+	}
+}
+
+func TestTransientError(t *testing.T) {
+	for _, err := range []error{
+		context.DeadlineExceeded,
+		fmt.Errorf("lock(build:foo): %w", context.DeadlineExceeded),
+		asTransientError(fmt.Errorf("build 'v135/foo@1.0.0/es2022/foo.mjs': timeout(10m0s)")),
+		asTransientError(fmt.Errorf("npm: could not get metadata of package 'foo' (503 Service Unavailable: )")),
+		&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+	} {
+		if !isTransientError(err) {
+			t.Fatalf("expected '%v' to be transient", err)
+		}
+	}
+	// the errors are classified by the type instead of the text
+	for _, err := range []error{
+		errors.New("npm: package 'foo' not found"),
+		errors.New(`esbuild: Could not resolve "bar"`),
+		errors.New(`esbuild: Could not resolve "./timeout(1).js"`),
+		errors.New("npm: could not get metadata of package 'foo' (503 Service Unavailable: )"),
+	} {
+		if isTransientError(err) {
+			t.Fatalf("expected '%v' to be deterministic", err)
+		}
+	}
+
+	if !isPnpmFetchError("ERR_PNPM_META_FETCH_FAIL GET https://registry.npmjs.org/foo: request to https://registry.npmjs.org/foo failed, reason: ECONNRESET") {
+		t.Fatal("expected the fetch error of pnpm")
+	}
+	if isPnpmFetchError("ERR_PNPM_NO_MATCHING_VERSION No matching version found for foo@9.9.9") {
+		t.Fatal("unexpected fetch error of pnpm")
+	}
+}
+
+func TestWorkerReportTransientError(t *testing.T) {
+	yes, no := true, false
+	for _, c := range []struct {
+		report    workerReport
+		transient bool
+	}{
+		{workerReport{Error: "install 'foo@1.0.0': timeout(5m0s)", Transient: &yes}, true},
+		{workerReport{Error: `esbuild: Could not resolve "./timeout(1).js"`, Transient: &no}, false},
+		// the workers that don't report the flag
+		{workerReport{Error: "install 'foo@1.0.0': timeout(5m0s)"}, true},
+		{workerReport{Error: "npm: package 'foo' not found"}, false},
+	} {
+		output := c.report.output()
+		if output.err == nil || output.err.Error() != c.report.Error || isTransientError(output.err) != c.transient {
+			t.Fatalf("unexpected output of the report %+v: %v", c.report, output.err)
+		}
+	}
+}
+
+func TestBuildFailure(t *testing.T) {
+	setupTestStorage(t)
+
+	id := fmt.Sprintf("v%d/foo@1.0.0/es2022/foo.mjs", VERSION)
+	if _, ok := getBuildFailure(id); ok {
+		t.Fatal("unexpected failure record")
+	}
+
+	recordBuildFailure(id, context.Canceled)
+	if _, ok := getBuildFailure(id); ok {
+		t.Fatal("the cancelled build should not be recorded")
+	}
+
+	recordBuildFailure(id, errors.New("build failed"))
+	recordBuildFailure(id, errors.New("build failed again"))
+	f, ok := getBuildFailure(id)
+	if !ok {
+		t.Fatal("the failure record is missing")
+	}
+	if f.Attempts != 2 || f.Error != "build failed again" {
+		t.Fatalf("unexpected failure record: %+v", f)
+	}
+	if d := f.RetryAt - f.FailedAt; d != int64((2 * time.Minute).Seconds()) {
+		t.Fatalf("unexpected backoff: %ds", d)
+	}
+
+	ok, err := clearBuildFailure(id)
+	if err != nil || !ok {
+		t.Fatal("failed to clear the failure record")
+	}
+	if _, ok := getBuildFailure(id); ok {
+		t.Fatal("the failure record should be cleared")
+	}
+
+	// the backoff of the transient failures is capped
+	for i := 0; i < 10; i++ {
+		recordBuildFailure(id, asTransientError(fmt.Errorf("build '%s': timeout(10m0s)", id)))
+	}
+	f, ok = getBuildFailure(id)
+	if !ok || f.Attempts != 10 {
+		t.Fatalf("unexpected failure record: %+v", f)
+	}
+	if d := f.RetryAt - f.FailedAt; d != int64(failureTransientBackoffMax.Seconds()) {
+		t.Fatalf("unexpected backoff of the timeout: %ds", d)
+	}
+	n, err := clearBuildFailures()
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 cleared record, got %d, %v", n, err)
+	}
+}
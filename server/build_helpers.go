@@ -1,6 +1,8 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,12 +10,97 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/esm-dev/esm.sh/server/config"
 	"github.com/esm-dev/esm.sh/server/storage"
 	"github.com/evanw/esbuild/pkg/api"
 	"github.com/ije/gox/utils"
 )
 
+// context returns the context of the task, it's done when the task is cancelled.
+func (task *BuildTask) context() context.Context {
+	if task.ctx != nil {
+		return task.ctx
+	}
+	return context.Background()
+}
+
+// getBuildTimeouts returns the timeouts of the package builds.
+func getBuildTimeouts(pkgName string) config.Timeouts {
+	if cfg == nil {
+		return config.Timeouts{Build: config.Duration(10 * time.Minute)}
+	}
+	return cfg.BuildTimeouts.Get(pkgName)
+}
+
+// installPackage installs the package in the working directory with the install timeout of the
+// package, the install process is killed when the timeout is exceeded.
+func (task *BuildTask) installPackage(wd string, pkg Pkg) error {
+	return installPackageWithTimeout(task.context(), wd, pkg)
+}
+
+// installPackageWithTimeout installs the package with the install timeout of the package.
+func installPackageWithTimeout(parent context.Context, wd string, pkg Pkg) error {
+	ctx := parent
+	timeout := time.Duration(getBuildTimeouts(pkg.Name).Install)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := installPackage(ctx, wd, pkg)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && parent.Err() == nil {
+		err = asTransientError(fmt.Errorf("install '%s': timeout(%v)", pkg.VersionName(), timeout))
+	}
+	return err
+}
+
+// setStage sets the stage of the task and reports it to the stage hook.
+func (task *BuildTask) setStage(stage string) {
+	task.stageLock.Lock()
+	task.endStageLocked()
+	task.stage = stage
+	task.stageAt = time.Now()
+	task.stageLock.Unlock()
+	getBuildLog(task.context()).Printf("info", "stage: %s", stage)
+	if task.onStage != nil {
+		task.onStage(stage)
+	}
+}
+
+// getStage returns the current stage of the task.
+func (task *BuildTask) getStage() string {
+	task.stageLock.RLock()
+	defer task.stageLock.RUnlock()
+	return task.stage
+}
+
+// swapStage sets the stage without the stage hook and returns the previous stage, it's used to
+// update the stage of the task that is built by a remote worker.
+func (task *BuildTask) swapStage(stage string) string {
+	task.stageLock.Lock()
+	defer task.stageLock.Unlock()
+	prev := task.stage
+	task.stage = stage
+	return prev
+}
+
+// endStage records the duration of the current stage.
+func (task *BuildTask) endStage() {
+	task.stageLock.Lock()
+	defer task.stageLock.Unlock()
+	task.endStageLocked()
+}
+
+func (task *BuildTask) endStageLocked() {
+	if task.stage != "" && task.stage != "pending" && !task.stageAt.IsZero() {
+		metricBuildStageDuration.ObserveSince(task.stageAt, task.stage, task.Target)
+		getBuildLog(task.context()).Printf("info", "stage %s done in %v", task.stage, time.Since(task.stageAt))
+		task.stageAt = time.Time{}
+	}
+}
+
 func (task *BuildTask) ID() string {
 	if task.id != "" {
 		return task.id
@@ -110,6 +197,15 @@ func (task *BuildTask) getSavepath() string {
 	return path.Join("builds", task.ID())
 }
 
+// writeBuildFile writes the build file to the storage, and returns the checksum of the content.
+func (task *BuildTask) writeBuildFile(content []byte) (checksum string, err error) {
+	_, err = writeStorageFile(task.context(), task.getSavepath(), bytes.NewReader(content))
+	if err != nil {
+		return
+	}
+	return checksumOf(content), nil
+}
+
 func (task *BuildTask) getPackageInfo(name string) (pkg Pkg, p NpmPackageInfo, fromPackageJSON bool, err error) {
 	pkgName, _, subpath := splitPkgPath(name)
 	var version string
@@ -122,7 +218,7 @@ func (task *BuildTask) getPackageInfo(name string) (pkg Pkg, p NpmPackageInfo, f
 	} else {
 		version = "latest"
 	}
-	p, fromPackageJSON, err = getPackageInfo(task.installDir, pkgName, version)
+	p, fromPackageJSON, err = getPackageInfoContext(task.context(), task.installDir, pkgName, version)
 	if err == nil {
 		pkg = Pkg{
 			Name:      p.Name,
@@ -146,6 +242,11 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 	wd := task.wd
 	pkg := task.Pkg
 
+	ctx, span := startSpan(task.context(), "analyze", "pkg", pkg.String())
+	defer func() {
+		span.End(err)
+	}()
+
 	var p NpmPackageInfo
 	err = utils.ParseJSONFile(path.Join(wd, "node_modules", pkg.Name, "package.json"), &p)
 	if err != nil {
@@ -333,7 +434,7 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 		npm.Module = ""
 
 		var ret cjsExportsResult
-		ret, err = cjsLexer(wd, path.Join(wd, "node_modules", pkg.Name, modulePath), nodeEnv)
+		ret, err = cjsLexer(ctx, wd, path.Join(wd, "node_modules", pkg.Name, modulePath), nodeEnv)
 		if err == nil && ret.Error != "" {
 			err = fmt.Errorf("cjsLexer: %s", ret.Error)
 		}
@@ -356,13 +457,13 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 				pkgs[i] = n + "@" + v
 				i++
 			}
-			err = pnpmInstall(wd, pkgs...)
+			err = pnpmInstall(ctx, wd, pkgs...)
 			if err != nil {
 				return
 			}
 		}
 		var ret cjsExportsResult
-		ret, err = cjsLexer(wd, pkg.ImportPath(), nodeEnv)
+		ret, err = cjsLexer(ctx, wd, pkg.ImportPath(), nodeEnv)
 		if err == nil && ret.Error != "" {
 			err = fmt.Errorf("cjsLexer: %s", ret.Error)
 		}
@@ -626,25 +727,53 @@ func (task *BuildTask) applyConditions(p *NpmPackageInfo, exports interface{}, p
 func queryESMBuild(id string) (*ESMBuild, bool) {
 	value, err := db.Get(id)
 	if err == nil && value != nil {
+		savePath, _ := getBuildSavePath(id)
 		var esm ESMBuild
 		err = json.Unmarshal(value, &esm)
 		if err == nil {
-			if strings.HasPrefix(id, "stable/") {
-				id = fmt.Sprintf("v%d/", STABLE_VERSION) + strings.TrimPrefix(id, "stable/")
-			}
 			if !esm.TypesOnly {
-				_, err = fs.Stat(path.Join("builds", id))
+				_, err = fs.Stat(savePath)
 			}
 			if err == nil || os.IsExist(err) {
 				return &esm, true
 			}
+			// don't remove the build on the transient errors of the storage
+			if err != storage.ErrNotFound && !os.IsNotExist(err) {
+				log.Warnf("fs.Stat(%s): %v", savePath, err)
+				return nil, false
+			}
 		}
-		// delete the invalid db entry
+		// delete the invalid db entry and the orphaned files
 		db.Delete(id)
+		removeESMBuildFiles(savePath)
 	}
 	return nil, false
 }
 
+// getBuildSavePath returns the storage path of the build id, the stable builds are
+// stored in the `builds/v{STABLE_VERSION}` directory. It returns false if the id is
+// not a build id.
+func getBuildSavePath(id string) (savePath string, ok bool) {
+	if strings.HasPrefix(id, "stable/") {
+		return path.Join(fmt.Sprintf("builds/v%d", STABLE_VERSION), strings.TrimPrefix(id, "stable/")), true
+	}
+	_, ok = parseBuildVersion(id)
+	return path.Join("builds", id), ok
+}
+
+// removeESMBuildFiles removes the build file and its sibling source map and css files.
+func removeESMBuildFiles(savePath string) {
+	for _, name := range []string{
+		savePath,
+		savePath + ".map",
+		strings.TrimSuffix(savePath, path.Ext(savePath)) + ".css",
+	} {
+		if err := fs.Remove(name); err != nil {
+			log.Warnf("fs.Remove(%s): %v", name, err)
+		}
+	}
+}
+
 var jsExts = []string{".mjs", ".js", ".jsx", ".mts", ".ts", ".tsx"}
 
 func esmLexer(wd string, packageName string, moduleSpecifier string) (resolvedName string, namedExports []string, err error) {
@@ -720,6 +849,33 @@ func copyRawBuildFile(id string, name string, dir string) (err error) {
 	return
 }
 
+// esbuild runs the build with the options, the build is cancelled when the context is done.
+func esbuild(ctx context.Context, options api.BuildOptions) (result api.BuildResult) {
+	_, span := startSpan(ctx, "esbuild", "bundle", options.Bundle)
+	defer func() {
+		span.SetAttr("errors", len(result.Errors))
+		span.SetAttr("warnings", len(result.Warnings))
+		span.End(ctx.Err())
+	}()
+
+	buildCtx, ctxErr := api.Context(options)
+	if ctxErr != nil {
+		return api.BuildResult{Errors: ctxErr.Errors}
+	}
+	defer buildCtx.Dispose()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			buildCtx.Cancel()
+		case <-done:
+		}
+	}()
+	return buildCtx.Rebuild()
+}
+
 func bundleNodePolyfill(name string, globalName string, namedExport string, target api.Target) ([]byte, error) {
 	ret := api.Build(api.BuildOptions{
 		Stdin: &api.StdinOptions{
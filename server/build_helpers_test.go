@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+type unavailableFS struct {
+	storage.FileSystem
+}
+
+func (unavailableFS) Stat(name string) (storage.FileStat, error) {
+	return nil, errors.New("s3: 503 Service Unavailable")
+}
+
+func TestQueryESMBuild(t *testing.T) {
+	setupTestStorage(t)
+
+	id := fmt.Sprintf("v%d/foo@1.0.0/es2022/foo.mjs", VERSION)
+	savePath, _ := getBuildSavePath(id)
+	db.Put(id, utils.MustEncodeJSON(ESMBuild{}))
+	fs.WriteFile(savePath, strings.NewReader("export default 1"))
+
+	if _, ok := queryESMBuild(id); !ok {
+		t.Fatal("the build should be found")
+	}
+
+	// the transient error of the storage doesn't remove the build
+	localFS := fs
+	fs = unavailableFS{localFS}
+	if _, ok := queryESMBuild(id); ok {
+		t.Fatal("the build should not be found if the storage is unavailable")
+	}
+	fs = localFS
+	if _, ok := queryESMBuild(id); !ok {
+		t.Fatal("the build should be kept on the transient error")
+	}
+
+	// the build record of the missing file is removed
+	fs.Remove(savePath)
+	if _, ok := queryESMBuild(id); ok {
+		t.Fatal("the build of the missing file should not be found")
+	}
+	if value, _ := db.Get(id); value != nil {
+		t.Fatal("the build record should be removed")
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/rex"
+)
+
+// The log of a build, it captures the output of the subprocesses (pnpm, cjs lexer), the esbuild
+// warnings and errors, the implicit externals, and the timings of the stages. The log is stored in
+// `build-logs/{buildId}.log` when the build is finished, and is served by the `GET /_build-log/{buildId}`
+// endpoint for the package authors to diagnose the builds.
+
+// the max size of a build log, the overflowed lines are dropped
+const buildLogMaxSize = 256 * 1024
+
+type buildLogKey struct{}
+
+// BuildLog is the log of a build, the methods are no-op on a nil log.
+type BuildLog struct {
+	lock      sync.Mutex
+	buf       bytes.Buffer
+	start     time.Time
+	truncated bool
+}
+
+func newBuildLog() *BuildLog {
+	return &BuildLog{start: time.Now()}
+}
+
+// withBuildLog returns a copy of the context that carries the build log, the log is shared by
+// the subtasks (e.g. the deps of a bundle) that are built with the same context.
+func withBuildLog(ctx context.Context, l *BuildLog) context.Context {
+	return context.WithValue(ctx, buildLogKey{}, l)
+}
+
+// getBuildLog returns the build log of the context, or nil.
+func getBuildLog(ctx context.Context) *BuildLog {
+	l, _ := ctx.Value(buildLogKey{}).(*BuildLog)
+	return l
+}
+
+// Printf writes a line to the log with the elapsed time and the level, e.g.
+// `[+1.204s] warn: implicit external 'fsevents'`.
+func (l *BuildLog) Printf(level string, format string, v ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.write(fmt.Sprintf("[+%.3fs] %s: %s\n", time.Since(l.start).Seconds(), level, fmt.Sprintf(format, v...)))
+}
+
+// Output writes the output of a subprocess to the log, the lines are indented.
+func (l *BuildLog) Output(title string, output []byte) {
+	if l == nil {
+		return
+	}
+	output = bytes.TrimSpace(output)
+	if len(output) == 0 {
+		return
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "[+%.3fs] output: %s\n", time.Since(l.start).Seconds(), title)
+	for _, line := range bytes.Split(output, []byte{'\n'}) {
+		buf.WriteString("    ")
+		buf.Write(bytes.TrimRight(line, "\r"))
+		buf.WriteByte('\n')
+	}
+	l.write(buf.String())
+}
+
+func (l *BuildLog) write(s string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.truncated {
+		return
+	}
+	if l.buf.Len()+len(s) > buildLogMaxSize {
+		l.buf.WriteString("... (truncated)\n")
+		l.truncated = true
+		return
+	}
+	l.buf.WriteString(s)
+}
+
+// Bytes returns the content of the log.
+func (l *BuildLog) Bytes() []byte {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]byte(nil), l.buf.Bytes()...)
+}
+
+// formatEsbuildMessage formats the esbuild message with the location, e.g.
+// `node_modules/foo/index.js:1:7: Could not resolve "bar"`.
+func formatEsbuildMessage(msg api.Message) string {
+	if msg.Location == nil {
+		return msg.Text
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", msg.Location.File, msg.Location.Line, msg.Location.Column, msg.Text)
+}
+
+// getBuildLogPath returns the storage path of the build log.
+func getBuildLogPath(id string) string {
+	return "build-logs/" + id + ".log"
+}
+
+// saveBuildLog stores the log of the build, the log of the previous build is replaced.
+func saveBuildLog(id string, l *BuildLog) {
+	if l == nil || fs == nil {
+		return
+	}
+	if _, err := fs.WriteFile(getBuildLogPath(id), bytes.NewReader(l.Bytes())); err != nil {
+		log.Warnf("fs.WriteFile(%s): %v", getBuildLogPath(id), err)
+	}
+}
+
+// buildLogHandler handles the `GET /_build-log/{buildId}` requests.
+func buildLogHandler(ctx *rex.Context, id string) interface{} {
+	if _, ok := getBuildSavePath(id); !ok || strings.Contains(id, "..") {
+		return rex.Status(404, "invalid build id")
+	}
+
+	header := ctx.W.Header()
+	header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	if buildQueue.Has(id) {
+		header.Set("Retry-After", fmt.Sprintf("%d", buildStatusRetryAfter))
+		return rex.Status(http.StatusAccepted, "the build is in progress")
+	}
+
+	r, err := fs.OpenFile(getBuildLogPath(id))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return rex.Status(404, "build log not found")
+		}
+		return rex.Status(500, err.Error())
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return rex.Status(500, err.Error())
+	}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	return data
+}
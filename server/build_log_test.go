@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestBuildLog(t *testing.T) {
+	setupTestStorage(t)
+
+	l := newBuildLog()
+	ctx, cancel := context.WithCancel(withBuildLog(context.Background(), l))
+	defer cancel()
+
+	task := &BuildTask{Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022", ctx: ctx}
+	task.setStage("install")
+	getBuildLog(ctx).Output("pnpm add foo@1.0.0", []byte("Progress: resolved 1\r\n WARN deprecated bar@1.0.0\n"))
+	getBuildLog(ctx).Output("cjs lexer", []byte("  \n"))
+	task.setStage("build")
+	getBuildLog(ctx).Printf("warn", "implicit external '%s', rebuilding", "fsevents")
+
+	lines := strings.Split(strings.TrimSpace(string(l.Bytes())), "\n")
+	expected := []string{
+		"info: stage: install",
+		"output: pnpm add foo@1.0.0",
+		"    Progress: resolved 1",
+		"     WARN deprecated bar@1.0.0",
+		"info: stage install done in",
+		"info: stage: build",
+		"warn: implicit external 'fsevents', rebuilding",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("unexpected log:\n%s", l.Bytes())
+	}
+	for i, line := range lines {
+		if !strings.Contains(line, expected[i]) {
+			t.Fatalf("expected '%s' in the line %d of the log:\n%s", expected[i], i+1, l.Bytes())
+		}
+	}
+
+	// the log is saved in the storage
+	saveBuildLog("v135/foo@1.0.0/es2022/foo.mjs", l)
+	if _, err := fs.Stat("build-logs/v135/foo@1.0.0/es2022/foo.mjs.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the overflowed lines are dropped
+	l = newBuildLog()
+	for i := 0; i < buildLogMaxSize/16; i++ {
+		l.Printf("info", "%s", strings.Repeat("x", 16))
+	}
+	if data := l.Bytes(); len(data) > buildLogMaxSize+32 || !strings.HasSuffix(string(data), "... (truncated)\n") {
+		t.Fatalf("expected the log to be truncated, got %d bytes", len(data))
+	}
+
+	// the methods of the nil log are no-op
+	getBuildLog(context.Background()).Printf("info", "noop")
+}
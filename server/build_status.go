@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+// The async build protocol, a client opts in by the `?async` query or the `Prefer: respond-async`
+// header to not hold the connection while the module is being built:
+//   - the module request responds `202 Accepted` with the status url in the `Location` header
+//   - `GET /_build/{buildId}` responds `202` with the stage of the build until it's done, then
+//     redirects to the built module, or responds `500` with the error if the build is failed
+//
+// The build stays interactive while the client is polling, it's cancelled (or demoted) like the build
+// of a gone client if the status is not polled within the `asyncBuildTTL`.
+
+// the interval in seconds that the clients should poll the build status
+const buildStatusRetryAfter = 1
+
+// the async client is considered gone if it doesn't poll the build status within the ttl
+const asyncBuildTTL = 10 * buildStatusRetryAfter * time.Second
+
+// isAsync checks if the client opts in the async build protocol.
+func isAsync(ctx *rex.Context) bool {
+	if ctx.Form.Has("async") {
+		return true
+	}
+	for _, v := range ctx.R.Header.Values("Prefer") {
+		for _, p := range strings.Split(v, ",") {
+			if strings.TrimSpace(p) == "respond-async" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptBuild responds the status url of the build that is queued.
+func acceptBuild(ctx *rex.Context, id string, cdnOrigin string) interface{} {
+	statusUrl := fmt.Sprintf("%s%s/_build/%s", cdnOrigin, cfg.CdnBasePath, id)
+	header := ctx.W.Header()
+	header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	header.Set("Location", statusUrl)
+	header.Set("Retry-After", fmt.Sprintf("%d", buildStatusRetryAfter))
+	header.Add("Vary", "Prefer")
+	return rex.Status(http.StatusAccepted, map[string]interface{}{
+		"id":     id,
+		"stage":  "pending",
+		"status": statusUrl,
+	})
+}
+
+// buildStatusHandler handles the `GET /_build/{buildId}` requests.
+func buildStatusHandler(ctx *rex.Context, id string, cdnOrigin string) interface{} {
+	header := ctx.W.Header()
+	header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+
+	if _, ok := getBuildSavePath(id); !ok {
+		return rex.Status(404, map[string]interface{}{"id": id, "error": "invalid build id"})
+	}
+
+	if status, ok := buildQueue.PollTask(id); ok {
+		stage, _ := status["stage"].(string)
+		status["id"] = id
+		status["progress"] = buildStageProgress[stage]
+		header.Set("Retry-After", fmt.Sprintf("%d", buildStatusRetryAfter))
+		return rex.Status(http.StatusAccepted, status)
+	}
+
+	if esm, ok := queryESMBuild(id); ok {
+		if esm.TypesOnly {
+			dtsUrl := fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, strings.TrimPrefix(esm.Dts, "/"))
+			header.Set("X-TypeScript-Types", dtsUrl)
+			header.Set("Content-Type", "application/javascript; charset=utf-8")
+			return []byte("export default null;\n")
+		}
+		return rex.Redirect(fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, id), http.StatusFound)
+	}
+
+	f, err := loadBuildFailure(id)
+	if err != nil {
+		return rex.Status(500, map[string]interface{}{"id": id, "error": err.Error()})
+	}
+	if f != nil {
+		return rex.Status(500, map[string]interface{}{"id": id, "stage": "failed", "error": f.Error})
+	}
+	return rex.Status(404, map[string]interface{}{"id": id, "error": "build not found"})
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+func TestIsAsync(t *testing.T) {
+	request := func(url string, prefer string) *rex.Context {
+		r := httptest.NewRequest("GET", url, nil)
+		if prefer != "" {
+			r.Header.Set("Prefer", prefer)
+		}
+		return &rex.Context{W: httptest.NewRecorder(), R: r, Form: &rex.Form{R: r}}
+	}
+
+	if isAsync(request("/react@18.2.0", "")) {
+		t.Fatal("the request should not be async")
+	}
+	if !isAsync(request("/react@18.2.0?async", "")) {
+		t.Fatal("the request with the `async` query should be async")
+	}
+	if !isAsync(request("/react@18.2.0", "wait=10, respond-async")) {
+		t.Fatal("the request with the `Prefer: respond-async` header should be async")
+	}
+}
+
+func TestAcceptBuild(t *testing.T) {
+	cfg = &config.Config{}
+	w := httptest.NewRecorder()
+	ctx := &rex.Context{W: w, R: httptest.NewRequest("GET", "/react@18.2.0?async", nil)}
+
+	res := acceptBuild(ctx, "v135/react@18.2.0/es2022/react.mjs", "https://esm.sh")
+	expected := rex.Status(http.StatusAccepted, map[string]interface{}{
+		"id":     "v135/react@18.2.0/es2022/react.mjs",
+		"stage":  "pending",
+		"status": "https://esm.sh/_build/v135/react@18.2.0/es2022/react.mjs",
+	})
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("unexpected response %v", res)
+	}
+	if w.Header().Get("Location") != "https://esm.sh/_build/v135/react@18.2.0/es2022/react.mjs" || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("unexpected headers %v", w.Header())
+	}
+}
+
+func TestBuildStatusHandler(t *testing.T) {
+	setupTestStorage(t)
+	buildQueue = newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+	defer func() { buildQueue = nil }()
+
+	status := func(id string) (interface{}, http.Header) {
+		w := httptest.NewRecorder()
+		res := buildStatusHandler(&rex.Context{W: w, R: httptest.NewRequest("GET", "/_build/"+id, nil)}, id, "https://esm.sh")
+		return res, w.Header()
+	}
+
+	if res, _ := status("foo"); !reflect.DeepEqual(res, rex.Status(404, map[string]interface{}{"id": "foo", "error": "invalid build id"})) {
+		t.Fatalf("expected 404 of the invalid build id, got %v", res)
+	}
+
+	// the queued build
+	id := "v135/foo@1.0.0/es2022/foo.mjs"
+	task := &BuildTask{Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022", id: id}
+	_, err := buildQueue.Add(task, BuildClient{IP: "1.1.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stage := range []string{"pending", "install"} {
+		task.setStage(stage)
+		expected, _ := buildQueue.TaskStatus(id)
+		expected["id"] = id
+		expected["progress"] = buildStageProgress[stage]
+		if expected["stage"] != stage {
+			t.Fatalf("expected the stage %s, got %v", stage, expected["stage"])
+		}
+		res, header := status(id)
+		if !reflect.DeepEqual(res, rex.Status(http.StatusAccepted, expected)) {
+			t.Fatalf("expected 202 of the queued build, got %v", res)
+		}
+		if header.Get("Retry-After") != "1" {
+			t.Fatalf("expected the `Retry-After` header, got %v", header)
+		}
+	}
+
+	// the build is done
+	buildQueue = newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+	db.Put(id, utils.MustEncodeJSON(ESMBuild{}))
+	fs.WriteFile("builds/"+id, strings.NewReader("export default 1"))
+	if res, _ := status(id); !reflect.DeepEqual(res, rex.Redirect("https://esm.sh/"+id, http.StatusFound)) {
+		t.Fatalf("expected the redirect to the module, got %v", res)
+	}
+
+	// the build is failed
+	id = "v135/bar@1.0.0/es2022/bar.mjs"
+	recordBuildFailure(id, errors.New("boom"))
+	if res, _ := status(id); !reflect.DeepEqual(res, rex.Status(500, map[string]interface{}{"id": id, "stage": "failed", "error": "boom"})) {
+		t.Fatalf("expected 500 of the failed build, got %v", res)
+	}
+
+	// unknown build
+	id = "v135/baz@1.0.0/es2022/baz.mjs"
+	if res, _ := status(id); !reflect.DeepEqual(res, rex.Status(404, map[string]interface{}{"id": id, "error": "build not found"})) {
+		t.Fatalf("expected 404 of the unknown build, got %v", res)
+	}
+}
@@ -81,8 +81,12 @@ type cjsExportsResult struct {
 	Stack         string   `json:"stack"`
 }
 
-func cjsLexer(cwd string, importPath string, nodeEnv string) (ret cjsExportsResult, err error) {
+func cjsLexer(ctx context.Context, cwd string, importPath string, nodeEnv string) (ret cjsExportsResult, err error) {
 	start := time.Now()
+	ctx, span := startSpan(ctx, "cjsLexer", "importPath", importPath)
+	defer func() {
+		span.End(err)
+	}()
 	args := map[string]interface{}{
 		"cwd":        cwd,
 		"importPath": importPath,
@@ -97,21 +101,24 @@ func cjsLexer(cwd string, importPath string, nodeEnv string) (ret cjsExportsResu
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	var outBuf bytes.Buffer
 	var errBuf bytes.Buffer
 
-	cmd := exec.CommandContext(ctx, "node", "cjs_lexer.js")
+	cmd := exec.Command("node", "cjs_lexer.js")
 	cmd.Dir = path.Join(cfg.WorkDir, "ns")
 	cmd.Stdin = bytes.NewBuffer(utils.MustEncodeJSON(args))
 	cmd.Stdout = &outBuf
 	cmd.Stderr = &errBuf
 
-	err = cmd.Run()
+	err = runCommand(ctx, cmd)
+	metricSubprocessDuration.ObserveSince(start, "cjs_lexer")
+	buildLog := getBuildLog(ctx)
+	buildLog.Output(fmt.Sprintf("cjs lexer %s (%v)", importPath, time.Since(start)), errBuf.Bytes())
 	if err != nil {
-		if errBuf.Len() > 0 {
+		if errBuf.Len() > 0 && ctx.Err() == nil {
 			err = fmt.Errorf("cjsLexer: %s", errBuf.String())
 		}
 		return
@@ -125,10 +132,14 @@ func cjsLexer(cwd string, importPath string, nodeEnv string) (ret cjsExportsResu
 	if ret.Error != "" {
 		if ret.Stack != "" {
 			log.Errorf("[cjsLexer] %s\n---\n%s\n---", ret.Error, ret.Stack)
+			buildLog.Printf("error", "cjs lexer: %s", ret.Error)
+			buildLog.Output("cjs lexer stack", []byte(ret.Stack))
 		} else {
 			log.Errorf("[cjsLexer] %s", ret.Error)
+			buildLog.Printf("error", "cjs lexer: %s", ret.Error)
 		}
 	} else {
+		buildLog.Printf("info", "cjs lexer: %s has %d exports", importPath, len(ret.Exports))
 		log.Debugf("[cjsLexer] parse %s in %s", importPath, time.Since(start))
 	}
 
@@ -9,31 +9,188 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/ije/gox/utils"
 )
 
 type Config struct {
-	Port             uint16    `json:"port,omitempty"`
-	TlsPort          uint16    `json:"tlsPort,omitempty"`
-	BuildConcurrency uint16    `json:"buildConcurrency,omitempty"`
-	BanList          BanList   `json:"banList,omitempty"`
-	AllowList        AllowList `json:"allowList,omitempty"`
-	AuthSecret       string    `json:"authSecret,omitempty"`
-	WorkDir          string    `json:"workDir,omitempty"`
-	Cache            string    `json:"cache,omitempty"`
-	Database         string    `json:"database,omitempty"`
-	Storage          string    `json:"storage,omitempty"`
-	LogLevel         string    `json:"logLevel,omitempty"`
-	LogDir           string    `json:"logDir,omitempty"`
-	CdnOrigin        string    `json:"cdnOrigin,omitempty"`
-	CdnBasePath      string    `json:"cdnBasePath,omitempty"`
-	NpmRegistry      string    `json:"npmRegistry,omitempty"`
-	NpmToken         string    `json:"npmToken,omitempty"`
-	NpmRegistryScope string    `json:"npmRegistryScope,omitempty"`
-	NpmUser          string    `json:"npmUser,omitempty"`
-	NpmPassword      string    `json:"npmPassword,omitempty"`
-	NoCompress       bool      `json:"noCompress,omitempty"`
+	Port             uint16        `json:"port,omitempty"`
+	TlsPort          uint16        `json:"tlsPort,omitempty"`
+	BuildConcurrency uint16        `json:"buildConcurrency,omitempty"`
+	BanList          BanList       `json:"banList,omitempty"`
+	AllowList        AllowList     `json:"allowList,omitempty"`
+	AuthSecret       string        `json:"authSecret,omitempty"`
+	MetricsToken     string        `json:"metricsToken,omitempty"`
+	WorkDir          string        `json:"workDir,omitempty"`
+	Cache            string        `json:"cache,omitempty"`
+	Database         string        `json:"database,omitempty"`
+	Storage          string        `json:"storage,omitempty"`
+	Locker           string        `json:"locker,omitempty"`
+	LogLevel         string        `json:"logLevel,omitempty"`
+	LogDir           string        `json:"logDir,omitempty"`
+	CdnOrigin        string        `json:"cdnOrigin,omitempty"`
+	CdnBasePath      string        `json:"cdnBasePath,omitempty"`
+	NpmRegistry      string        `json:"npmRegistry,omitempty"`
+	NpmToken         string        `json:"npmToken,omitempty"`
+	NpmRegistryScope string        `json:"npmRegistryScope,omitempty"`
+	NpmUser          string        `json:"npmUser,omitempty"`
+	NpmPassword      string        `json:"npmPassword,omitempty"`
+	NoCompress       bool          `json:"noCompress,omitempty"`
+	GC               GC            `json:"gc,omitempty"`
+	BuildLimits      BuildLimits   `json:"buildLimits,omitempty"`
+	BuildCancel      BuildCancel   `json:"buildCancel,omitempty"`
+	BuildTimeouts    BuildTimeouts `json:"buildTimeouts,omitempty"`
+	Workers          Workers       `json:"workers,omitempty"`
+	Prefetch         Prefetch      `json:"prefetch,omitempty"`
+	Tracing          Tracing       `json:"tracing,omitempty"`
+}
+
+// Tracing is the config of the build pipeline tracing, the spans are exported in the OTLP json
+// format to an OTLP/HTTP collector, or to a local json-lines file. It's disabled if neither
+// the `otlpEndpoint` nor the `file` is set.
+type Tracing struct {
+	// OtlpEndpoint is the OTLP/HTTP traces endpoint, e.g. `http://localhost:4318/v1/traces`.
+	OtlpEndpoint string `json:"otlpEndpoint,omitempty"`
+	// OtlpHeaders are the extra headers of the OTLP requests, e.g. the api key of the collector.
+	OtlpHeaders map[string]string `json:"otlpHeaders,omitempty"`
+	// File is the json-lines file to append the spans to, a batch of spans (the OTLP `TracesData`) per line,
+	// the file can be read by the `otlpjsonfile` receiver of the OpenTelemetry collector.
+	File string `json:"file,omitempty"`
+	// ServiceName is the `service.name` resource attribute of the spans, default is "esm.sh".
+	ServiceName string `json:"serviceName,omitempty"`
+}
+
+// Prefetch is the config of the prebuilds of the dependencies, the deps of a build are built in
+// background as soon as the build is done, so they are ready when the browser requests them.
+type Prefetch struct {
+	// Enabled prefetches the deps of every build, otherwise only the builds requested with `?prefetch`.
+	Enabled bool `json:"enabled,omitempty"`
+	// Depth is the max depth of the dependency graph to prefetch, default is 3.
+	Depth int `json:"depth,omitempty"`
+}
+
+// Workers is the config of the remote build workers, the workers pull the build tasks from
+// the server with the auth secret, and write the builds to the shared storage.
+type Workers struct {
+	// Enabled enables the worker endpoints `/_worker/*`, the authSecret is required.
+	Enabled bool `json:"enabled,omitempty"`
+	// NoLocalBuilds disables the builds in the server process, all the builds are run by the workers.
+	NoLocalBuilds bool `json:"noLocalBuilds,omitempty"`
+	// LeaseTTL is the time a worker holds a task without heartbeat, the task is requeued after it. default is 60s.
+	LeaseTTL Duration `json:"leaseTTL,omitempty"`
+}
+
+// Timeouts is the timeouts of a build, the work is stopped (and the subprocesses are killed) when
+// a timeout is exceeded. A negative timeout (e.g. "-1s") is for no limit, and a zero timeout is
+// unset: it falls back to the default (or to the global one for a per-package override).
+type Timeouts struct {
+	// Build is the timeout of the whole build, including the install and the dts transform,
+	// default is 10 minutes.
+	Build Duration `json:"build,omitempty"`
+	// Install is the timeout of the package install, default is no limit other than the build timeout.
+	Install Duration `json:"install,omitempty"`
+	// DTS is the timeout of the dts transform, default is no limit other than the build timeout.
+	DTS Duration `json:"dts,omitempty"`
+}
+
+// BuildTimeouts is the global timeouts of the builds with the per-package overrides.
+type BuildTimeouts struct {
+	Timeouts
+	// Packages is the overrides of the packages, the key is the package name or the scope (e.g. "@babylonjs"),
+	// the unset timeouts of an override fall back to the global ones.
+	Packages map[string]Timeouts `json:"packages,omitempty"`
+}
+
+// Get returns the timeouts of the package.
+func (b *BuildTimeouts) Get(pkgName string) Timeouts {
+	t := b.Timeouts
+	override, ok := b.Packages[pkgName]
+	if !ok && strings.HasPrefix(pkgName, "@") {
+		scope, _ := utils.SplitByFirstByte(pkgName, '/')
+		override, ok = b.Packages[scope]
+	}
+	if ok {
+		if override.Build != 0 {
+			t.Build = override.Build
+		}
+		if override.Install != 0 {
+			t.Install = override.Install
+		}
+		if override.DTS != 0 {
+			t.DTS = override.DTS
+		}
+	}
+	return t
+}
+
+// BuildCancel is the policy to cancel the builds that all the waiting clients have gone.
+type BuildCancel struct {
+	// Disabled disables the cancellation, the abandoned builds are always finished.
+	Disabled bool `json:"disabled,omitempty"`
+	// FinishThreshold is the estimated progress (0-1) over which the abandoned builds are finished, default is 0.8.
+	FinishThreshold float64 `json:"finishThreshold,omitempty"`
+}
+
+// BuildLimits is the config of the per-client limits of the build queue. A client is identified by
+// the bearer token if the token is listed in the tokens, otherwise by the ip.
+type BuildLimits struct {
+	// MaxQueuedPerClient is the max number of builds a client can have in the queue, default is 100,
+	// negative for no limit.
+	MaxQueuedPerClient int `json:"maxQueuedPerClient,omitempty"`
+	// MaxProcessesPerClient is the max number of builds of a client in process, default is half of
+	// the build concurrency (at least one), negative for no limit.
+	MaxProcessesPerClient int `json:"maxProcessesPerClient,omitempty"`
+	// RetryAfter is the `Retry-After` of the 429 response when a client is over the limits.
+	RetryAfter Duration `json:"retryAfter,omitempty"`
+	// Tokens is the bearer tokens of the clients with their weights in the fair scheduling, the
+	// tokens are accepted by the auth besides the auth secret, but not for the admin endpoints.
+	Tokens map[string]int `json:"tokens,omitempty"`
+	// Weights is the weights of the clients (ip) in the fair scheduling, default is 1.
+	Weights map[string]int `json:"weights,omitempty"`
+	// MaxQueueLength is the max number of the pending interactive builds, the new build requests over
+	// it get 503 with the `Retry-After` estimated from the recent build throughput. Zero for no limit.
+	MaxQueueLength int `json:"maxQueueLength,omitempty"`
+	// MaxWait is the max estimated waiting time of a new build in the queue, the new build requests
+	// over it get 503 like the `MaxQueueLength`. Zero for no limit.
+	MaxWait Duration `json:"maxWait,omitempty"`
+}
+
+// GC is the config of the garbage collection of outdated builds and unused npm install directories.
+type GC struct {
+	// Interval is the interval to run the gc periodically, zero to disable the scheduled gc.
+	Interval Duration `json:"interval,omitempty"`
+	// KeepVersions is the number of build versions to keep, including the current one.
+	KeepVersions int `json:"keepVersions,omitempty"`
+	// NpmMaxAge is the max age since last access of the npm install directories, zero to keep all.
+	NpmMaxAge Duration `json:"npmMaxAge,omitempty"`
+}
+
+// Duration is a `time.Duration` that can be decoded from a string like "24h" or a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(time.Duration(value * float64(time.Second)))
+	case string:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration '%s'", value)
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 type BanList struct {
@@ -151,6 +308,9 @@ func fixConfig(c *Config) *Config {
 	if c.Storage == "" {
 		c.Storage = fmt.Sprintf("local:%s", path.Join(c.WorkDir, "storage"))
 	}
+	if c.Locker == "" {
+		c.Locker = "memory"
+	}
 	if c.LogDir == "" {
 		c.LogDir = path.Join(c.WorkDir, "log")
 	}
@@ -186,6 +346,39 @@ func fixConfig(c *Config) *Config {
 	if c.AuthSecret == "" {
 		c.AuthSecret = os.Getenv("SERVER_AUTH_SECRET")
 	}
+	if c.MetricsToken == "" {
+		c.MetricsToken = os.Getenv("SERVER_METRICS_TOKEN")
+	}
+	if c.BuildLimits.MaxQueuedPerClient == 0 {
+		c.BuildLimits.MaxQueuedPerClient = 100
+	}
+	if c.BuildLimits.MaxProcessesPerClient == 0 {
+		c.BuildLimits.MaxProcessesPerClient = int(c.BuildConcurrency) / 2
+		if c.BuildLimits.MaxProcessesPerClient < 1 {
+			c.BuildLimits.MaxProcessesPerClient = 1
+		}
+	}
+	if c.BuildLimits.RetryAfter <= 0 {
+		c.BuildLimits.RetryAfter = Duration(30 * time.Second)
+	}
+	if c.BuildCancel.FinishThreshold <= 0 {
+		c.BuildCancel.FinishThreshold = 0.8
+	}
+	if c.Workers.LeaseTTL <= 0 {
+		c.Workers.LeaseTTL = Duration(time.Minute)
+	}
+	if c.GC.KeepVersions <= 0 {
+		c.GC.KeepVersions = 2
+	}
+	if c.Prefetch.Depth <= 0 {
+		c.Prefetch.Depth = 3
+	}
+	if c.BuildTimeouts.Build == 0 {
+		c.BuildTimeouts.Build = Duration(10 * time.Minute)
+	}
+	if c.Tracing.ServiceName == "" {
+		c.Tracing.ServiceName = "esm.sh"
+	}
 	return c
 }
 
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 )
 
 func TestExtractPackageName(t *testing.T) {
@@ -282,3 +284,85 @@ func TestBanList_IsPackageBanned(t *testing.T) {
 		})
 	}
 }
+
+func TestDuration(t *testing.T) {
+	var c struct {
+		A Duration `json:"a"`
+		B Duration `json:"b"`
+	}
+	err := json.Unmarshal([]byte(`{"a":"24h","b":90}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(c.A) != 24*time.Hour {
+		t.Fatalf("invalid duration %v, should be 24h", time.Duration(c.A))
+	}
+	if time.Duration(c.B) != 90*time.Second {
+		t.Fatalf("invalid duration %v, should be 90s", time.Duration(c.B))
+	}
+	err = json.Unmarshal([]byte(`{"a":"1 day"}`), &c)
+	if err == nil {
+		t.Fatal("should be an error for invalid duration")
+	}
+}
+
+func TestBuildTimeouts(t *testing.T) {
+	var c Config
+	err := json.Unmarshal([]byte(`{
+		"buildTimeouts": {
+			"build": "5m",
+			"install": "2m",
+			"packages": {
+				"typescript": { "build": "30m", "dts": "20m" },
+				"maplibre-gl": { "build": "-1s" },
+				"@babylonjs": { "install": "10m" }
+			}
+		}
+	}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]Timeouts{
+		"react":           {Build: Duration(5 * time.Minute), Install: Duration(2 * time.Minute)},
+		"typescript":      {Build: Duration(30 * time.Minute), Install: Duration(2 * time.Minute), DTS: Duration(20 * time.Minute)},
+		"@babylonjs/core": {Build: Duration(5 * time.Minute), Install: Duration(10 * time.Minute)},
+		"@types/react":    {Build: Duration(5 * time.Minute), Install: Duration(2 * time.Minute)},
+		"maplibre-gl":     {Build: Duration(-time.Second), Install: Duration(2 * time.Minute)},
+	} {
+		if got := c.BuildTimeouts.Get(name); got != want {
+			t.Fatalf("unexpected timeouts of '%s': %+v, want %+v", name, got, want)
+		}
+	}
+
+	// the build timeout is 10 minutes by default, and can be no limit
+	fixConfig(&c)
+	if c.BuildTimeouts.Build != Duration(5*time.Minute) {
+		t.Fatalf("unexpected build timeout %v", time.Duration(c.BuildTimeouts.Build))
+	}
+	c = Config{}
+	fixConfig(&c)
+	if c.BuildTimeouts.Build != Duration(10*time.Minute) {
+		t.Fatalf("unexpected default build timeout %v", time.Duration(c.BuildTimeouts.Build))
+	}
+	c = Config{BuildTimeouts: BuildTimeouts{Timeouts: Timeouts{Build: -1}}}
+	fixConfig(&c)
+	if c.BuildTimeouts.Build >= 0 {
+		t.Fatalf("the no-limit build timeout should be kept, got %v", time.Duration(c.BuildTimeouts.Build))
+	}
+}
+
+func TestBuildLimitsDefaults(t *testing.T) {
+	c := fixConfig(&Config{BuildConcurrency: 8})
+	if c.BuildLimits.MaxQueuedPerClient != 100 || c.BuildLimits.MaxProcessesPerClient != 4 {
+		t.Fatalf("unexpected default limits: %+v", c.BuildLimits)
+	}
+	c = fixConfig(&Config{BuildConcurrency: 1})
+	if c.BuildLimits.MaxProcessesPerClient != 1 {
+		t.Fatalf("unexpected default limits: %+v", c.BuildLimits)
+	}
+	// negative for no limit
+	c = fixConfig(&Config{BuildLimits: BuildLimits{MaxQueuedPerClient: -1, MaxProcessesPerClient: -1}})
+	if c.BuildLimits.MaxQueuedPerClient != -1 || c.BuildLimits.MaxProcessesPerClient != -1 {
+		t.Fatalf("unexpected limits: %+v", c.BuildLimits)
+	}
+}
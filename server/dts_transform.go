@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -15,17 +16,29 @@ import (
 	"github.com/ije/gox/utils"
 )
 
-func (task *BuildTask) TransformDTS(dts string) (n int, err error) {
+// TransformDTS transforms the dts file and the imported dts files, it stops when the context is done.
+func (task *BuildTask) TransformDTS(ctx context.Context, dts string) (n int, err error) {
+	ctx, span := startSpan(ctx, "transformDTS", "dts", dts)
+	defer func() {
+		span.SetAttr("files", n)
+		span.End(err)
+	}()
+
 	buildArgsPrefix := encodeBuildArgsPrefix(task.Args, task.Pkg, true)
 	marker := newStringSet()
-	err = task.transformDTS(dts, buildArgsPrefix, marker)
+	err = task.transformDTS(ctx, dts, buildArgsPrefix, marker)
 	if err == nil {
 		n = marker.Len()
 	}
 	return
 }
 
-func (task *BuildTask) transformDTS(dts string, aliasDepsPrefix string, marker *stringSet) (err error) {
+func (task *BuildTask) transformDTS(ctx context.Context, dts string, aliasDepsPrefix string, marker *stringSet) (err error) {
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
+
 	// don't transform repeatly
 	if marker.Has(aliasDepsPrefix + dts) {
 		return
@@ -320,7 +333,7 @@ func (task *BuildTask) transformDTS(dts string, aliasDepsPrefix string, marker *
 		io.Copy(buf, footer)
 	}
 
-	_, err = fs.WriteFile(savePath, buf)
+	_, err = writeStorageFile(ctx, savePath, buf)
 	if err != nil {
 		return
 	}
@@ -342,7 +355,7 @@ func (task *BuildTask) transformDTS(dts string, aliasDepsPrefix string, marker *
 		}
 		wg.Add(1)
 		go func(importDts string) {
-			err := task.transformDTS(importDts, aliasDepsPrefix, marker)
+			err := task.transformDTS(ctx, importDts, aliasDepsPrefix, marker)
 			if err != nil {
 				errors = append(errors, err)
 			}
@@ -392,6 +405,7 @@ func (task *BuildTask) toTypesPath(wd string, p NpmPackageInfo, version string,
 			},
 			Target: task.Target,
 			Dev:    false,
+			ctx:    task.ctx,
 			wd:     wd,
 		}
 		_, p, _, e := t.analyze(false)
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -108,10 +109,80 @@ func apiHandler() rex.Handle {
 					"url":       fmt.Sprintf("%s/~%s", cdnOrigin, id),
 					"bundleUrl": fmt.Sprintf("%s/~%s?bundle", cdnOrigin, id),
 				}
+			case "/_gc":
+				// the gc endpoint is only available when the auth secret is set
+				if cfg.AuthSecret == "" {
+					return rex.Err(403, "forbidden")
+				}
+				report, err := runGC(ctx.Form.Has("dryRun"))
+				if err != nil {
+					if err == errGCRunning {
+						return rex.Err(409, err.Error())
+					}
+					return rex.Err(500, err.Error())
+				}
+				log.Infof("gc: %s", report)
+				return report
+			case "/_fsck":
+				// the fsck endpoint is only available when the auth secret is set
+				if cfg.AuthSecret == "" {
+					return rex.Err(403, "forbidden")
+				}
+				report, err := runFsck(ctx.Form.Has("repair"))
+				if err != nil {
+					return rex.Err(500, err.Error())
+				}
+				log.Infof("fsck: %s", report)
+				return report
+			case "/_clear-failure":
+				// clears the failure record of `?id={buildId}` or all the records with `?all`
+				if cfg.AuthSecret == "" {
+					return rex.Err(403, "forbidden")
+				}
+				if ctx.Form.Has("all") {
+					n, err := clearBuildFailures()
+					if err != nil {
+						return rex.Err(500, err.Error())
+					}
+					return map[string]interface{}{"cleared": n}
+				}
+				id := strings.TrimPrefix(ctx.Form.Value("id"), "/")
+				if id == "" {
+					return rex.Err(400, "id is required")
+				}
+				ok, err := clearBuildFailure(id)
+				if err != nil {
+					return rex.Err(500, err.Error())
+				}
+				if !ok {
+					return rex.Err(404, "failure record not found")
+				}
+				return map[string]interface{}{"cleared": 1}
+			case "/_prewarm":
+				// the prewarm endpoint is only available when the auth secret is set
+				if cfg.AuthSecret == "" {
+					return rex.Err(403, "forbidden")
+				}
+				return prewarmHandler(ctx)
+			case "/_worker/lease", "/_worker/heartbeat", "/_worker/report":
+				// the worker endpoints are only available when the auth secret is set
+				if !cfg.Workers.Enabled || cfg.AuthSecret == "" {
+					return rex.Err(403, "forbidden")
+				}
+				return workerHandler(ctx)
 			default:
 				return rex.Err(404, "not found")
 			}
 		}
+		if ctx.R.Method == "GET" && ctx.Path.String() == "/_prewarm" {
+			if cfg.AuthSecret == "" {
+				return rex.Err(403, "forbidden")
+			}
+			return prewarmHandler(ctx)
+		}
+		if ctx.R.Method == "GET" && ctx.Path.String() == "/metrics" {
+			return metricsHandler(ctx)
+		}
 		return nil
 	}
 }
@@ -302,9 +373,39 @@ func build(input BuildInput, cdnOrigin string) (id string, err error) {
 	return
 }
 
+// hasBearerToken checks if the request has the bearer token of one of the tokens, the empty
+// tokens are ignored.
+func hasBearerToken(ctx *rex.Context, tokens ...string) bool {
+	auth := ctx.R.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	bearer := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for _, token := range tokens {
+		if token != "" && subtle.ConstantTimeCompare(bearer, []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdminPath checks if the path is an admin endpoint that requires the auth secret.
+func isAdminPath(pathname string) bool {
+	return strings.HasPrefix(pathname, "/_") || pathname == "/metrics"
+}
+
 func auth(secret string) rex.Handle {
 	return func(ctx *rex.Context) interface{} {
 		if secret != "" && ctx.R.Header.Get("Authorization") != "Bearer "+secret {
+			// the metrics can be scraped with the metrics token instead of the auth secret
+			if ctx.Path.String() == "/metrics" && hasBearerToken(ctx, cfg.MetricsToken) {
+				return nil
+			}
+			// the clients of the build limits can request the modules with their tokens, but not the
+			// admin endpoints
+			if !isAdminPath(ctx.Path.String()) && getClientToken(ctx) != "" {
+				return nil
+			}
 			return rex.Status(401, "Unauthorized")
 		}
 		return nil
@@ -29,6 +29,10 @@ func esmHandler() rex.Handle {
 		header := ctx.W.Header()
 		cdnOrigin := getCdnOrign(ctx)
 
+		// the root span of the request, it's the parent of the build spans
+		span := startRequestSpan(ctx)
+		defer span.End(nil)
+
 		// ban malicious requests
 		if strings.HasPrefix(pathname, ".") || strings.HasSuffix(pathname, ".php") {
 			return rex.Status(404, "not found")
@@ -77,6 +81,21 @@ func esmHandler() rex.Handle {
 			}
 		}
 
+		// the status of the async build
+		if strings.HasPrefix(pathname, "/_build/") {
+			return buildStatusHandler(ctx, strings.TrimPrefix(pathname, "/_build/"), cdnOrigin)
+		}
+
+		// the log of the build
+		if strings.HasPrefix(pathname, "/_build-log/") {
+			return buildLogHandler(ctx, strings.TrimPrefix(pathname, "/_build-log/"))
+		}
+
+		// the event stream of the build queue
+		if pathname == "/_events" {
+			return buildEventsHandler(ctx)
+		}
+
 		// static routes
 		switch pathname {
 		case "/":
@@ -105,35 +124,22 @@ func esmHandler() rex.Handle {
 			for el := buildQueue.list.Front(); el != nil; el = el.Next() {
 				t, ok := el.Value.(*queueTask)
 				if ok {
-					m := map[string]interface{}{
-						"bundle":    t.BundleDeps,
-						"bv":        t.BuildVersion,
-						"consumers": t.consumers,
-						"createdAt": t.createdAt.Format(http.TimeFormat),
-						"dev":       t.Dev,
-						"inProcess": t.inProcess,
-						"pkg":       t.Pkg.String(),
-						"stage":     t.stage,
-						"target":    t.Target,
-					}
-					if !t.startedAt.IsZero() {
-						m["startedAt"] = t.startedAt.Format(http.TimeFormat)
-					}
-					if len(t.Args.deps) > 0 {
-						m["deps"] = t.Args.deps.String()
-					}
-					q[i] = m
+					q[i] = t.status()
 					i++
 				}
 			}
 			buildQueue.lock.RUnlock()
 
 			header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
-			return map[string]interface{}{
+			status := map[string]interface{}{
 				"buildQueue": q[:i],
 				"version":    BUILD_VERSION,
 				"uptime":     time.Since(startTime).String(),
 			}
+			if cfg.Workers.Enabled {
+				status["workers"] = buildQueue.Workers(time.Duration(cfg.Workers.LeaseTTL))
+			}
+			return status
 
 		case "/esma-target":
 			return getBuildTargetByUA(userAgent)
@@ -418,7 +424,7 @@ func esmHandler() rex.Handle {
 			extname := path.Ext(reqPkg.SubPath)
 			dir := path.Join(cfg.WorkDir, "npm", reqPkg.Name+"@"+reqPkg.Version)
 			if !dirExists(dir) {
-				err := installPackage(dir, reqPkg)
+				err := installPackageWithTimeout(ctx.R.Context(), dir, reqPkg)
 				if err != nil {
 					return rex.Status(500, err.Error())
 				}
@@ -461,7 +467,7 @@ func esmHandler() rex.Handle {
 		if strings.HasPrefix(reqPkg.Name, "@types/") && (reqPkg.SubModule == "" || !strings.HasSuffix(reqPkg.SubModule, ".d.ts")) {
 			url := fmt.Sprintf("%s%s/v%d%s", cdnOrigin, cfg.CdnBasePath, BUILD_VERSION, pathname)
 			if reqPkg.SubModule == "" {
-				info, _, err := getPackageInfo("", reqPkg.Name, reqPkg.Version)
+				info, _, err := getPackageInfoContext(ctx.R.Context(), "", reqPkg.Name, reqPkg.Version)
 				if err != nil {
 					return rex.Status(500, err.Error())
 				}
@@ -607,6 +613,9 @@ func esmHandler() rex.Handle {
 			installDir := fmt.Sprintf("npm/%s", reqPkg.VersionName())
 			savePath := path.Join(cfg.WorkDir, installDir, "node_modules", reqPkg.Name, reqPkg.SubPath)
 			fi, err := os.Lstat(savePath)
+			if err == nil {
+				touchDir(path.Join(cfg.WorkDir, installDir))
+			}
 			if err != nil {
 				if os.IsExist(err) {
 					return rex.Status(500, err.Error())
@@ -621,26 +630,31 @@ func esmHandler() rex.Handle {
 						exports:    newStringSet(),
 						conditions: newStringSet(),
 					},
-					Target: "raw",
+					Target:      "raw",
+					traceparent: span.Context().traceparent(),
 				}
-				c := buildQueue.Add(task, ctx.RemoteIP())
-				select {
-				case output := <-c.C:
-					if output.err != nil {
-						return rex.Status(500, "Fail to install package: "+output.err.Error())
-					}
-					fi, err = os.Lstat(savePath)
-					if err != nil {
-						if os.IsExist(err) {
-							return rex.Status(500, err.Error())
-						}
-						return rex.Status(404, "File Not Found")
-					}
-				case <-time.After(10 * time.Minute):
-					buildQueue.RemoveConsumer(task, c)
+				if f, failed := getBuildFailure(task.ID()); failed {
+					return rex.Status(500, "Fail to install package: "+f.Error)
+				}
+				c, err := buildQueue.Add(task, getBuildClient(ctx))
+				if err != nil {
+					return throwTooManyBuilds(ctx, err)
+				}
+				output, ok := waitBuild(ctx, task, c)
+				if !ok {
 					header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
 					return rex.Status(http.StatusRequestTimeout, "timeout, we are downloading package hardly, please try again later!")
 				}
+				if output.err != nil {
+					return rex.Status(500, "Fail to install package: "+output.err.Error())
+				}
+				fi, err = os.Lstat(savePath)
+				if err != nil {
+					if os.IsExist(err) {
+						return rex.Status(500, err.Error())
+					}
+					return rex.Status(404, "File Not Found")
+				}
 			}
 
 			content, err := os.Open(savePath)
@@ -835,18 +849,11 @@ func esmHandler() rex.Handle {
 
 		// parse and use `X-` prefix
 		if hasBuildVerPrefix {
-			a := strings.Split(reqPkg.SubModule, "/")
-			if len(a) > 1 && strings.HasPrefix(a[0], "X-") {
-				reqPkg.SubModule = strings.Join(a[1:], "/")
-				args, err := decodeBuildArgsPrefix(a[0])
-				if err != nil {
-					return throwErrorJS(ctx, err, false)
-				}
-				reqPkg.SubPath = strings.Join(strings.Split(reqPkg.SubPath, "/")[1:], "/")
-				if args.denoStdVersion == "" {
-					// ensure deno/std version used
-					args.denoStdVersion = denoStdVersion
-				}
+			args, ok, err := splitBuildArgsPrefix(&reqPkg)
+			if err != nil {
+				return throwErrorJS(ctx, err, false)
+			}
+			if ok {
 				buildArgs = args
 			}
 		}
@@ -863,60 +870,37 @@ func esmHandler() rex.Handle {
 		// check if it's build path
 		isBarePath := false
 		if hasBuildVerPrefix && (endsWith(reqPkg.SubPath, ".mjs", ".js", ".css")) {
-			a := strings.Split(reqPkg.SubModule, "/")
-			if len(a) > 0 {
-				maybeTarget := a[0]
-				if _, ok := targets[maybeTarget]; ok {
-					submodule := strings.Join(a[1:], "/")
-					pkgName := strings.TrimSuffix(path.Base(reqPkg.Name), ".js")
-					if strings.HasSuffix(submodule, ".css") && !strings.HasSuffix(reqPkg.SubPath, ".js") {
-						if submodule == pkgName+".css" {
-							reqPkg.SubModule = ""
-							target = maybeTarget
-							isBarePath = true
-						} else {
-							url := fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, reqPkg.String())
-							return rex.Redirect(url, http.StatusFound)
-						}
-					} else {
-						if strings.HasSuffix(submodule, ".bundle") {
-							submodule = strings.TrimSuffix(submodule, ".bundle")
-							bundleDeps = true
-						} else if strings.HasSuffix(submodule, ".bundless") {
-							submodule = strings.TrimSuffix(submodule, ".bundless")
-							noBundle = true
-						}
-						if strings.HasSuffix(submodule, ".development") {
-							submodule = strings.TrimSuffix(submodule, ".development")
-							isDev = true
-						}
-						isMjs := strings.HasSuffix(reqPkg.SubPath, ".mjs")
-						// fix old build `/stable/react/deno/react.js` to `/stable/react/deno/react.mjs`
-						if !isMjs && submodule == pkgName && stableBuild[reqPkg.Name] {
-							url := fmt.Sprintf(
-								"%s%s/stable/%s@%s/%s/%s.mjs",
-								cdnOrigin,
-								cfg.CdnBasePath,
-								reqPkg.Name,
-								reqPkg.Version,
-								maybeTarget,
-								reqPkg.Name,
-							)
-							return rex.Redirect(url, http.StatusMovedPermanently)
-						}
-						if strings.HasPrefix(reqPkg.Name, "~") {
-							submodule = ""
-						} else if isMjs && submodule == pkgName {
-							submodule = ""
-						}
-						// workaround for es5-ext weird "/#/" path
-						if submodule != "" && reqPkg.Name == "es5-ext" {
-							submodule = strings.ReplaceAll(submodule, "/$$/", "/#/")
-						}
-						reqPkg.SubModule = submodule
-						target = maybeTarget
+			if bp, ok := parseBuildPath(reqPkg); ok {
+				pkgName := strings.TrimSuffix(path.Base(reqPkg.Name), ".js")
+				if strings.HasSuffix(reqPkg.SubModule, ".css") && !strings.HasSuffix(reqPkg.SubPath, ".js") {
+					if bp.submodule == pkgName+".css" {
+						reqPkg.SubModule = ""
+						target = bp.target
 						isBarePath = true
+					} else {
+						url := fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, reqPkg.String())
+						return rex.Redirect(url, http.StatusFound)
 					}
+				} else {
+					bundleDeps = bundleDeps || bp.bundleDeps
+					noBundle = noBundle || bp.noBundle
+					isDev = isDev || bp.dev
+					// fix old build `/stable/react/deno/react.js` to `/stable/react/deno/react.mjs`
+					if !strings.HasSuffix(reqPkg.SubPath, ".mjs") && bp.submodule == pkgName && stableBuild[reqPkg.Name] {
+						url := fmt.Sprintf(
+							"%s%s/stable/%s@%s/%s/%s.mjs",
+							cdnOrigin,
+							cfg.CdnBasePath,
+							reqPkg.Name,
+							reqPkg.Version,
+							bp.target,
+							reqPkg.Name,
+						)
+						return rex.Redirect(url, http.StatusMovedPermanently)
+					}
+					reqPkg.SubModule = bp.entrySubmodule(reqPkg)
+					target = bp.target
+					isBarePath = true
 				}
 			}
 		}
@@ -956,18 +940,23 @@ func esmHandler() rex.Handle {
 					BuildVersion: buildVersion,
 					Pkg:          reqPkg,
 					Target:       "types",
+					traceparent:  span.Context().traceparent(),
 				}
-				c := buildQueue.Add(task, ctx.RemoteIP())
-				select {
-				case output := <-c.C:
-					if output.err != nil {
-						return rex.Status(500, "types: "+output.err.Error())
-					}
-				case <-time.After(10 * time.Minute):
-					buildQueue.RemoveConsumer(task, c)
+				if f, failed := getBuildFailure(task.ID()); failed {
+					return rex.Status(500, "types: "+f.Error)
+				}
+				c, err := buildQueue.Add(task, getBuildClient(ctx))
+				if err != nil {
+					return throwTooManyBuilds(ctx, err)
+				}
+				output, ok := waitBuild(ctx, task, c)
+				if !ok {
 					header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
 					return rex.Status(http.StatusRequestTimeout, "timeout, we are transforming the types hardly, please try again later!")
 				}
+				if output.err != nil {
+					return rex.Status(500, "types: "+output.err.Error())
+				}
 			}
 			savePath, fi, err := findDts()
 			if err != nil {
@@ -994,10 +983,19 @@ func esmHandler() rex.Handle {
 			Dev:          isDev,
 			BundleDeps:   bundleDeps || isWorker,
 			NoBundle:     noBundle,
+			Prefetch:     getPrefetchDepth(ctx),
+			traceparent:  span.Context().traceparent(),
 		}
 
 		buildId := task.ID()
 		esm, hasBuild := queryESMBuild(buildId)
+		span.SetAttr("build.id", buildId)
+		span.SetAttr("build.cached", hasBuild)
+		if hasBuild {
+			metricCacheRequests.Inc("build", "hit")
+		} else {
+			metricCacheRequests.Inc("build", "miss")
+		}
 		fallback := false
 
 		if !hasBuild {
@@ -1018,34 +1016,49 @@ func esmHandler() rex.Handle {
 			// if the previous build exists and is not pin/bare mode, then build current module in backgound,
 			// or wait the current build task for 60 seconds
 			if esm != nil {
-				buildQueue.Add(task, "")
+				// don't retry the failed build in the backoff window
+				if _, failed := getBuildFailure(task.ID()); !failed {
+					buildQueue.Add(task, BuildClient{})
+				}
 			} else {
-				c := buildQueue.Add(task, ctx.RemoteIP())
-				select {
-				case output := <-c.C:
-					if output.err != nil {
-						msg := output.err.Error()
-						if strings.Contains(msg, "no such file or directory") ||
-							strings.Contains(msg, "is not exported from package") {
-							// redirect old build path (.js) to new build path (.mjs)
-							if strings.HasSuffix(reqPkg.SubPath, "/"+reqPkg.Name+".js") {
-								url := strings.TrimSuffix(ctx.R.URL.String(), ".js") + ".mjs"
-								return rex.Redirect(url, http.StatusMovedPermanently)
-							}
-							header.Set("Cache-Control", "public, max-age=31536000, immutable")
-							return rex.Status(404, "Module not found")
-						}
-						if strings.HasSuffix(msg, " not found") {
-							return rex.Status(404, msg)
+				var output BuildOutput
+				if f, failed := getBuildFailure(task.ID()); failed {
+					output.err = f.Err()
+				} else {
+					c, err := buildQueue.Add(task, getBuildClient(ctx))
+					if err != nil {
+						return throwTooManyBuilds(ctx, err)
+					}
+					// respond the status url instead of waiting for the build
+					if isAsync(ctx) {
+						go buildQueue.ExpireConsumer(task, c, asyncBuildTTL)
+						return acceptBuild(ctx, task.ID(), cdnOrigin)
+					}
+					var ok bool
+					output, ok = waitBuild(ctx, task, c)
+					if !ok {
+						header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+						return rex.Status(http.StatusRequestTimeout, "timeout, we are building the package hardly, please try again later!")
+					}
+				}
+				if output.err != nil {
+					msg := output.err.Error()
+					if strings.Contains(msg, "no such file or directory") ||
+						strings.Contains(msg, "is not exported from package") {
+						// redirect old build path (.js) to new build path (.mjs)
+						if strings.HasSuffix(reqPkg.SubPath, "/"+reqPkg.Name+".js") {
+							url := strings.TrimSuffix(ctx.R.URL.String(), ".js") + ".mjs"
+							return rex.Redirect(url, http.StatusMovedPermanently)
 						}
-						return throwErrorJS(ctx, output.err, false)
+						header.Set("Cache-Control", "public, max-age=31536000, immutable")
+						return rex.Status(404, "Module not found")
 					}
-					esm = output.meta
-				case <-time.After(10 * time.Minute):
-					buildQueue.RemoveConsumer(task, c)
-					header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
-					return rex.Status(http.StatusRequestTimeout, "timeout, we are building the package hardly, please try again later!")
+					if strings.HasSuffix(msg, " not found") {
+						return rex.Status(404, msg)
+					}
+					return throwErrorJS(ctx, output.err, false)
 				}
+				esm = output.meta
 			}
 		}
 
@@ -1212,6 +1225,70 @@ func throwErrorJS(ctx *rex.Context, err error, static bool) interface{} {
 	return rex.Status(500, buf)
 }
 
+// getBuildClient returns the client of the build request, the bearer token is only taken as the
+// identity of the client if it's one of the configured client tokens.
+func getBuildClient(ctx *rex.Context) BuildClient {
+	return BuildClient{IP: ctx.RemoteIP(), Token: getClientToken(ctx)}
+}
+
+// getClientToken returns the bearer token of the request if it's one of the client tokens of the
+// build limits, otherwise returns an empty string.
+func getClientToken(ctx *rex.Context) string {
+	for token := range cfg.BuildLimits.Tokens {
+		if hasBearerToken(ctx, token) {
+			return token
+		}
+	}
+	return ""
+}
+
+// getBuildWaitTimeout returns the time to wait for a build of the package, the build is stopped by
+// the queue when the build timeout is exceeded, the extra minute is for the queue waiting. It
+// returns 0 if the build timeout is no limit.
+func getBuildWaitTimeout(pkgName string) time.Duration {
+	timeout := time.Duration(getBuildTimeouts(pkgName).Build)
+	if timeout <= 0 {
+		return 0
+	}
+	return timeout + time.Minute
+}
+
+// waitBuild waits for the output of the build, it returns false if the client has gone or the
+// timeout is exceeded. The consumer is removed from the queue then, so the build is cancelled if
+// no one else is waiting for it.
+func waitBuild(ctx *rex.Context, task *BuildTask, c *BuildQueueConsumer) (output BuildOutput, ok bool) {
+	var timeout <-chan time.Time
+	if d := getBuildWaitTimeout(task.Pkg.Name); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case output = <-c.C:
+		return output, true
+	case <-ctx.R.Context().Done():
+	case <-timeout:
+	}
+	buildQueue.RemoveConsumer(task, c)
+	return
+}
+
+// throwTooManyBuilds responds 429 if the client is over the limits, or 503 if the build queue
+// is overloaded, with the `Retry-After` header.
+func throwTooManyBuilds(ctx *rex.Context, err error) interface{} {
+	ctx.W.Header().Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	if err == errQueueFull {
+		metricBuildsRejected.Inc("queue_full")
+		retryAfter := buildQueue.RetryAfter()
+		ctx.W.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())))
+		return rex.Status(http.StatusServiceUnavailable, "The build queue is full, please try again later")
+	}
+	metricBuildsRejected.Inc("client_limit")
+	retryAfter := time.Duration(cfg.BuildLimits.RetryAfter)
+	ctx.W.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())))
+	return rex.Status(http.StatusTooManyRequests, "Too many builds, please try again later")
+}
+
 func getTypesRoot(cdnOrigin string) string {
 	url, err := url.Parse(cdnOrigin)
 	if err != nil {
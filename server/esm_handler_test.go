@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+func TestGetBuildClient(t *testing.T) {
+	cfg = &config.Config{BuildLimits: config.BuildLimits{Tokens: map[string]int{"token": 2}}}
+
+	client := func(authorization string) BuildClient {
+		r := httptest.NewRequest("GET", "/react@18.2.0", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return getBuildClient(&rex.Context{W: httptest.NewRecorder(), R: r})
+	}
+
+	if c := client("Bearer token"); c.Token != "token" {
+		t.Fatalf("expected the client of the token, got %+v", c)
+	}
+	// the unknown tokens can't claim the identity (and the weight) of a client
+	for _, a := range []string{"", "Bearer", "Bearer tok", "Bearer other", "token"} {
+		if c := client(a); c.Token != "" || c.IP != "10.0.0.1" {
+			t.Fatalf("expected the client of the ip with the authorization '%s', got %+v", a, c)
+		}
+	}
+}
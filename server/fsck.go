@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+// FsckReport is the report of a fsck run.
+type FsckReport struct {
+	Repair    bool          `json:"repair,omitempty"`
+	StartedAt time.Time     `json:"startedAt"`
+	Duration  string        `json:"duration"`
+	Records   int           `json:"records"`
+	Files     int           `json:"files"`
+	Problems  []FsckProblem `json:"problems"`
+	Repaired  int           `json:"repaired"`
+}
+
+// FsckProblem is a mismatch between a db record and the storage.
+type FsckProblem struct {
+	Key     string `json:"key,omitempty"`
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+func (r *FsckReport) String() string {
+	return fmt.Sprintf(
+		"%d records, %d files checked in %s, %d problems found, %d repaired",
+		r.Records,
+		r.Files,
+		r.Duration,
+		len(r.Problems),
+		r.Repaired,
+	)
+}
+
+// runFsck verifies the build records against the build files in the storage:
+//   - the record is invalid json
+//   - the build file of the record is missing, empty or doesn't match the checksum
+//   - the build file has no record
+//   - the temporary file is left by a crashed write
+//
+// The broken records and files are removed in the repair mode, then they will be rebuilt on demand.
+func runFsck(repair bool) (report *FsckReport, err error) {
+	report = &FsckReport{Repair: repair, StartedAt: time.Now(), Problems: []FsckProblem{}}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt).Round(time.Millisecond).String()
+	}()
+
+	files := map[string]storage.FileStat{}
+	err = fs.Walk("builds", func(name string, stat storage.FileStat) error {
+		files[name] = stat
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	report.Files = len(files)
+
+	keys, err := db.List("")
+	if err != nil {
+		return
+	}
+	refs := map[string]bool{}
+	for _, key := range keys {
+		savePath, ok := getBuildSavePath(key)
+		if !ok {
+			continue
+		}
+		value, err := db.Get(key)
+		if err != nil {
+			return report, err
+		}
+		if value == nil {
+			continue
+		}
+		report.Records++
+
+		var problem string
+		var esm ESMBuild
+		if json.Unmarshal(value, &esm) != nil {
+			problem = "invalid record"
+		} else if !esm.TypesOnly {
+			problem, err = verifyBuildFile(savePath, esm.Checksum)
+			if err != nil {
+				return report, err
+			}
+		}
+		refs[savePath] = true
+		refs[savePath+".map"] = true
+		refs[strings.TrimSuffix(savePath, path.Ext(savePath))+".css"] = true
+		if problem == "" {
+			continue
+		}
+
+		report.Problems = append(report.Problems, FsckProblem{Key: key, Path: savePath, Problem: problem})
+		if repair {
+			if err := db.Delete(key); err != nil {
+				log.Warnf("fsck: db.Delete(%s): %v", key, err)
+				continue
+			}
+			removeESMBuildFiles(savePath)
+			report.Repaired++
+		}
+	}
+
+	orphans := []string{}
+	for name, stat := range files {
+		// skip the files of the builds in progress
+		if !refs[name] && time.Since(stat.ModTime()) > gcGracePeriod {
+			orphans = append(orphans, name)
+		}
+	}
+	sort.Strings(orphans)
+	for _, name := range orphans {
+		report.Problems = append(report.Problems, FsckProblem{Path: name, Problem: "orphaned file"})
+		if repair {
+			if err := fs.Remove(name); err != nil {
+				log.Warnf("fsck: fs.Remove(%s): %v", name, err)
+				continue
+			}
+			report.Repaired++
+		}
+	}
+
+	if w, ok := fs.(storage.TempFileWalker); ok {
+		stale := []string{}
+		err = w.WalkTempFiles("", func(name string, stat storage.FileStat) error {
+			// skip the temporary files of the writes in progress
+			if time.Since(stat.ModTime()) > gcGracePeriod {
+				stale = append(stale, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		for _, name := range stale {
+			report.Problems = append(report.Problems, FsckProblem{Path: name, Problem: "stale temporary file"})
+			if repair {
+				if err := fs.Remove(name); err != nil {
+					log.Warnf("fsck: fs.Remove(%s): %v", name, err)
+					continue
+				}
+				report.Repaired++
+			}
+		}
+	}
+	return
+}
+
+// verifyBuildFile checks the build file, the checksum is not verified for the legacy records without it.
+func verifyBuildFile(savePath string, checksum string) (problem string, err error) {
+	r, err := fs.OpenFile(savePath)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return "missing file", nil
+		}
+		return
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return
+	}
+	if len(data) == 0 {
+		return "empty file", nil
+	}
+	if checksum != "" && checksumOf(data) != checksum {
+		return "checksum mismatch", nil
+	}
+	return "", nil
+}
+
+func (c *adminClient) fsck(repair bool) (report *FsckReport, err error) {
+	pathname := "/_fsck"
+	if repair {
+		pathname += "?repair"
+	}
+	report = &FsckReport{}
+	err = c.do("POST", pathname, nil, report)
+	return
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+func TestFsck(t *testing.T) {
+	workDir := setupTestStorage(t)
+
+	old := time.Now().Add(-2 * gcGracePeriod)
+	writeBuild := func(id string, content string, checksum string) {
+		savePath, _ := getBuildSavePath(id)
+		if _, err := fs.WriteFile(savePath, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path.Join(workDir, "storage", savePath), old, old)
+		if err := db.Put(id, utils.MustEncodeJSON(ESMBuild{Checksum: checksum})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeBuild("v135/react@18.2.0/es2022/react.mjs", "export default 1", checksumOf([]byte("export default 1")))
+	writeBuild("stable/vue@3.3.4/es2022/vue.mjs", "export default 1", "")
+	writeBuild("v135/preact@10.0.0/es2022/preact.mjs", "export default", checksumOf([]byte("export default 1")))
+	writeBuild("v135/solid-js@1.0.0/es2022/solid-js.mjs", "", "")
+	db.Put("v135/vue@3.3.4/es2022/vue.mjs", []byte("{}"))
+	db.Put("v135/lit@3.0.0/es2022/lit.mjs", []byte("{"))
+	fs.WriteFile("builds/v135/lodash@4.17.21/es2022/lodash.mjs", strings.NewReader("export default 1"))
+	os.Chtimes(path.Join(workDir, "storage", "builds/v135/lodash@4.17.21/es2022/lodash.mjs"), old, old)
+	// the temporary files of a crashed write and a write in progress
+	os.WriteFile(path.Join(workDir, "storage", "builds/v135/lodash@4.17.21/es2022/.tmp-123"), []byte("export"), 0644)
+	os.Chtimes(path.Join(workDir, "storage", "builds/v135/lodash@4.17.21/es2022/.tmp-123"), old, old)
+	os.WriteFile(path.Join(workDir, "storage", "builds/v135/lodash@4.17.21/es2022/.tmp-456"), []byte("export"), 0644)
+
+	report, err := runFsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 6 || report.Files != 5 {
+		t.Fatalf("invalid report: %s", report)
+	}
+	problems := []string{}
+	for _, p := range report.Problems {
+		problems = append(problems, p.Problem+":"+p.Path)
+	}
+	if strings.Join(problems, ",") != strings.Join([]string{
+		"invalid record:builds/v135/lit@3.0.0/es2022/lit.mjs",
+		"checksum mismatch:builds/v135/preact@10.0.0/es2022/preact.mjs",
+		"empty file:builds/v135/solid-js@1.0.0/es2022/solid-js.mjs",
+		"missing file:builds/v135/vue@3.3.4/es2022/vue.mjs",
+		"orphaned file:builds/v135/lodash@4.17.21/es2022/lodash.mjs",
+		"stale temporary file:builds/v135/lodash@4.17.21/es2022/.tmp-123",
+	}, ",") {
+		t.Fatalf("invalid problems %v", problems)
+	}
+
+	report, err = runFsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired != 6 {
+		t.Fatalf("invalid report: %s", report)
+	}
+
+	report, err = runFsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || report.Records != 2 || report.Files != 2 {
+		t.Fatalf("invalid report after repair: %s", report)
+	}
+	if _, err := os.Stat(path.Join(workDir, "storage", "builds/v135/lodash@4.17.21/es2022/.tmp-456")); err != nil {
+		t.Fatal("the temporary file of the write in progress should be kept")
+	}
+}
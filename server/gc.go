@@ -0,0 +1,296 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+// the files that are not referenced by any db record are removed only if they are
+// older than the grace period, to avoid removing the files of the builds in progress.
+const gcGracePeriod = time.Hour
+
+var gcLock sync.Mutex
+
+var errGCRunning = errors.New("gc is running")
+
+// GCReport is the report of a gc run.
+type GCReport struct {
+	DryRun      bool      `json:"dryRun,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+	Duration    string    `json:"duration"`
+	Records     int       `json:"records"`
+	Files       int       `json:"files"`
+	FileBytes   int64     `json:"fileBytes"`
+	NpmDirs     int       `json:"npmDirs"`
+	NpmDirBytes int64     `json:"npmDirBytes"`
+	Errors      int       `json:"errors"`
+}
+
+func (r *GCReport) String() string {
+	return fmt.Sprintf(
+		"%d records, %d files (%s), %d npm dirs (%s) reclaimed in %s, %d errors",
+		r.Records,
+		r.Files,
+		formatBytes(r.FileBytes),
+		r.NpmDirs,
+		formatBytes(r.NpmDirBytes),
+		r.Duration,
+		r.Errors,
+	)
+}
+
+// runGC removes the outdated builds, the invalid db records, the orphaned files
+// and the unused npm install directories.
+func runGC(dryRun bool) (report *GCReport, err error) {
+	if !gcLock.TryLock() {
+		return nil, errGCRunning
+	}
+	defer gcLock.Unlock()
+
+	report = &GCReport{DryRun: dryRun, StartedAt: time.Now()}
+	gc := &gcRunner{
+		report:     report,
+		dryRun:     dryRun,
+		minVersion: VERSION - cfg.GC.KeepVersions + 1,
+	}
+	err = gc.gcBuilds()
+	if err == nil {
+		err = gc.gcTypes()
+	}
+	if err == nil {
+		err = gc.gcBuildLogs()
+	}
+	if err == nil && cfg.GC.NpmMaxAge > 0 {
+		err = gc.gcNpmDirs(time.Duration(cfg.GC.NpmMaxAge))
+	}
+	report.Duration = time.Since(report.StartedAt).Round(time.Millisecond).String()
+	return
+}
+
+// startGC runs the gc periodically in background.
+func startGC(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		report, err := runGC(false)
+		if err != nil {
+			log.Errorf("gc: %v", err)
+		} else {
+			log.Infof("gc: %s", report)
+		}
+	}
+}
+
+type gcRunner struct {
+	report     *GCReport
+	dryRun     bool
+	minVersion int
+}
+
+// isOutdated checks if the build version is outdated, the stable build version is always kept.
+func (gc *gcRunner) isOutdated(version int) bool {
+	return version < gc.minVersion && version != STABLE_VERSION
+}
+
+func (gc *gcRunner) removeFile(name string, size int64) {
+	if !gc.dryRun {
+		if err := fs.Remove(name); err != nil {
+			log.Warnf("gc: fs.Remove(%s): %v", name, err)
+			gc.report.Errors++
+			return
+		}
+	}
+	gc.report.Files++
+	gc.report.FileBytes += size
+}
+
+func (gc *gcRunner) gcBuilds() error {
+	// 1. remove the outdated build files, and collect the others
+	files := map[string]storage.FileStat{}
+	err := fs.Walk("builds", func(name string, stat storage.FileStat) error {
+		version, ok := parseBuildVersion(strings.TrimPrefix(name, "builds/"))
+		if ok && gc.isOutdated(version) {
+			gc.removeFile(name, stat.Size())
+		} else {
+			files[name] = stat
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 2. remove the outdated or invalid db records, and mark the referenced files
+	keys, err := db.List("")
+	if err != nil {
+		return err
+	}
+	refs := map[string]bool{}
+	for _, key := range keys {
+		if id := strings.TrimPrefix(key, "failure-"); id != key {
+			// remove the failure records of the outdated builds
+			if version, ok := parseBuildVersion(id); ok && gc.isOutdated(version) {
+				gc.removeRecord(key)
+			}
+			continue
+		}
+		savePath, ok := getBuildSavePath(key)
+		if !ok {
+			// not a build record
+			continue
+		}
+		if version, ok := parseBuildVersion(key); ok && gc.isOutdated(version) {
+			gc.removeRecord(key)
+			continue
+		}
+		value, err := db.Get(key)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+		var esm ESMBuild
+		if json.Unmarshal(value, &esm) != nil {
+			gc.removeRecord(key)
+			continue
+		}
+		if !esm.TypesOnly {
+			if _, ok := files[savePath]; !ok {
+				// the build may be finished after the walk
+				if _, err := fs.Stat(savePath); err == storage.ErrNotFound {
+					gc.removeRecord(key)
+					continue
+				}
+			}
+		}
+		refs[savePath] = true
+		refs[savePath+".map"] = true
+		refs[strings.TrimSuffix(savePath, path.Ext(savePath))+".css"] = true
+	}
+
+	// 3. remove the orphaned files
+	for name, stat := range files {
+		if !refs[name] && time.Since(stat.ModTime()) > gcGracePeriod {
+			gc.removeFile(name, stat.Size())
+		}
+	}
+	return nil
+}
+
+func (gc *gcRunner) removeRecord(key string) {
+	if !gc.dryRun {
+		if err := db.Delete(key); err != nil {
+			log.Warnf("gc: db.Delete(%s): %v", key, err)
+			gc.report.Errors++
+			return
+		}
+	}
+	gc.report.Records++
+}
+
+// gcTypes removes the outdated types, the types are stored in `types/{typesRoot}/v{version}/...`
+func (gc *gcRunner) gcTypes() error {
+	return fs.Walk("types", func(name string, stat storage.FileStat) error {
+		segments := strings.SplitN(name, "/", 4)
+		if len(segments) == 4 {
+			version, ok := parseBuildVersion(segments[2])
+			if ok && gc.isOutdated(version) {
+				gc.removeFile(name, stat.Size())
+			}
+		}
+		return nil
+	})
+}
+
+// gcBuildLogs removes the logs of the outdated builds, the logs are stored in `build-logs/{buildId}.log`.
+func (gc *gcRunner) gcBuildLogs() error {
+	return fs.Walk("build-logs", func(name string, stat storage.FileStat) error {
+		version, ok := parseBuildVersion(strings.TrimPrefix(name, "build-logs/"))
+		if ok && gc.isOutdated(version) {
+			gc.removeFile(name, stat.Size())
+		}
+		return nil
+	})
+}
+
+// gcNpmDirs removes the npm install directories that are not accessed in the max age.
+// the install directories are `npm/{name}@{version}`, `npm/@{scope}/{name}@{version}`
+// and `npm/gh/{owner}/{repo}@{version}`.
+func (gc *gcRunner) gcNpmDirs(maxAge time.Duration) error {
+	npmDir := path.Join(cfg.WorkDir, "npm")
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		entries, err := os.ReadDir(path.Join(npmDir, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			name := path.Join(dir, entry.Name())
+			if strings.IndexByte(entry.Name(), '@') <= 0 {
+				// scope or github owner directory
+				if depth < 2 {
+					if err := walk(name, depth+1); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			gc.removeNpmDir(name, maxAge)
+		}
+		return nil
+	}
+	return walk("", 0)
+}
+
+func (gc *gcRunner) removeNpmDir(pkgVersionName string, maxAge time.Duration) {
+	// skip the directory that is being installed
+	lock := getInstallLock(pkgVersionName)
+	if !lock.TryLock() {
+		return
+	}
+	defer lock.Unlock()
+
+	dir := path.Join(cfg.WorkDir, "npm", pkgVersionName)
+	fi, err := os.Stat(dir)
+	if err != nil || time.Since(fi.ModTime()) <= maxAge {
+		return
+	}
+	size := dirSize(dir)
+	if !gc.dryRun {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("gc: os.RemoveAll(%s): %v", dir, err)
+			gc.report.Errors++
+			return
+		}
+	}
+	gc.report.NpmDirs++
+	gc.report.NpmDirBytes += size
+}
+
+// parseBuildVersion parses the build version of the `v{version}/...` path.
+func parseBuildVersion(name string) (version int, ok bool) {
+	if !strings.HasPrefix(name, "v") {
+		return
+	}
+	s, _, _ := strings.Cut(name[1:], "/")
+	version, err := strconv.Atoi(s)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+// setupTestStorage sets up the local storage and the bolt database in a temporary work directory.
+func setupTestStorage(t *testing.T) (workDir string) {
+	var err error
+	workDir = t.TempDir()
+	cfg = &config.Config{WorkDir: workDir, GC: config.GC{KeepVersions: 2}}
+	fs, err = storage.OpenFS("local:" + path.Join(workDir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB("bolt:" + path.Join(workDir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return
+}
+
+func TestGC(t *testing.T) {
+	workDir := setupTestStorage(t)
+
+	old := time.Now().Add(-2 * gcGracePeriod)
+	writeFile := func(name string, modTime time.Time) {
+		if _, err := fs.WriteFile(name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path.Join(workDir, "storage", name), modTime, modTime)
+	}
+	putBuild := func(id string, esm ESMBuild) {
+		if err := db.Put(id, utils.MustEncodeJSON(esm)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	current := fmt.Sprintf("v%d", VERSION)
+	previous := fmt.Sprintf("v%d", VERSION-1)
+	outdated := fmt.Sprintf("v%d", VERSION-2)
+	stable := fmt.Sprintf("v%d", STABLE_VERSION)
+
+	// valid builds
+	putBuild(current+"/react@18.2.0/es2022/react.mjs", ESMBuild{})
+	writeFile("builds/"+current+"/react@18.2.0/es2022/react.mjs", old)
+	writeFile("builds/"+current+"/react@18.2.0/es2022/react.mjs.map", old)
+	putBuild(previous+"/react@18.2.0/es2022/react.mjs", ESMBuild{})
+	writeFile("builds/"+previous+"/react@18.2.0/es2022/react.mjs", old)
+	putBuild("stable/vue@3.3.4/es2022/vue.mjs", ESMBuild{})
+	writeFile("builds/"+stable+"/vue@3.3.4/es2022/vue.mjs", old)
+	putBuild(current+"/@types/react@18.2.0/X-ZHJlYWN0/types", ESMBuild{TypesOnly: true})
+	db.Put("publish-abc", []byte("{}"))
+
+	// outdated builds
+	putBuild(outdated+"/react@18.2.0/es2022/react.mjs", ESMBuild{})
+	writeFile("builds/"+outdated+"/react@18.2.0/es2022/react.mjs", time.Now())
+	writeFile("types/esm.sh/"+outdated+"/react@18.2.0/index.d.ts", time.Now())
+	writeFile("types/esm.sh/"+current+"/react@18.2.0/index.d.ts", time.Now())
+	writeFile("build-logs/"+outdated+"/react@18.2.0/es2022/react.mjs.log", time.Now())
+	writeFile("build-logs/"+current+"/react@18.2.0/es2022/react.mjs.log", time.Now())
+
+	// the record without build file
+	putBuild(current+"/vue@3.3.4/es2022/vue.mjs", ESMBuild{})
+	// the orphaned files
+	writeFile("builds/"+current+"/preact@10.0.0/es2022/preact.mjs", old)
+	writeFile("builds/"+current+"/preact@10.0.0/es2022/preact.css", old)
+	// the file of the build in progress
+	writeFile("builds/"+current+"/preact@10.0.1/es2022/preact.mjs", time.Now())
+
+	// npm install directories
+	cfg.GC.NpmMaxAge = config.Duration(24 * time.Hour)
+	for _, name := range []string{"react@18.2.0", "@vue/shared@3.3.4", "gh/ije/esm-dev@abc", "preact@10.0.0"} {
+		dir := path.Join(workDir, "npm", name)
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(path.Join(dir, "package.json"), []byte("{}"), 0644)
+		if name != "preact@10.0.0" {
+			os.Chtimes(dir, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))
+		}
+	}
+
+	report, err := runGC(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 2 || report.Files != 5 || report.NpmDirs != 3 {
+		t.Fatalf("invalid dry run report: %s", report)
+	}
+	if keys, _ := db.List(""); len(keys) != 7 {
+		t.Fatalf("dry run should not remove records, got %v", keys)
+	}
+
+	report, err = runGC(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 2 || report.Files != 5 || report.NpmDirs != 3 || report.Errors != 0 {
+		t.Fatalf("invalid report: %s", report)
+	}
+	if report.NpmDirBytes != 3*2 {
+		t.Fatalf("invalid npm dir bytes %d", report.NpmDirBytes)
+	}
+
+	keys, err := db.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != strings.Join([]string{
+		"publish-abc",
+		"stable/vue@3.3.4/es2022/vue.mjs",
+		previous + "/react@18.2.0/es2022/react.mjs",
+		current + "/@types/react@18.2.0/X-ZHJlYWN0/types",
+		current + "/react@18.2.0/es2022/react.mjs",
+	}, ",") {
+		t.Fatalf("invalid keys %v", keys)
+	}
+
+	files := []string{}
+	fs.Walk("", func(name string, stat storage.FileStat) error {
+		files = append(files, name)
+		return nil
+	})
+	if strings.Join(files, ",") != strings.Join([]string{
+		"build-logs/" + current + "/react@18.2.0/es2022/react.mjs.log",
+		"builds/" + stable + "/vue@3.3.4/es2022/vue.mjs",
+		"builds/" + previous + "/react@18.2.0/es2022/react.mjs",
+		"builds/" + current + "/preact@10.0.1/es2022/preact.mjs",
+		"builds/" + current + "/react@18.2.0/es2022/react.mjs",
+		"builds/" + current + "/react@18.2.0/es2022/react.mjs.map",
+		"types/esm.sh/" + current + "/react@18.2.0/index.d.ts",
+	}, ",") {
+		t.Fatalf("invalid files %v", files)
+	}
+
+	if !dirExists(path.Join(workDir, "npm", "preact@10.0.0")) {
+		t.Fatal("the recently used npm dir should be kept")
+	}
+	if dirExists(path.Join(workDir, "npm", "@vue/shared@3.3.4")) || dirExists(path.Join(workDir, "npm", "gh/ije/esm-dev@abc")) {
+		t.Fatal("the unused npm dirs should be removed")
+	}
+}
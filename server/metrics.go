@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+// The metrics in the Prometheus text format, they are served by the `GET /metrics` endpoint.
+
+// the buckets of the durations of the builds and subprocesses, in seconds
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// the buckets of the latencies of the network requests, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	metricBuildDuration = newHistogramVec(
+		"esm_build_duration_seconds",
+		"The duration of the builds from start to finish.",
+		durationBuckets,
+		"target", "status",
+	)
+	metricBuildStageDuration = newHistogramVec(
+		"esm_build_stage_duration_seconds",
+		"The duration of the build stages.",
+		durationBuckets,
+		"stage", "target",
+	)
+	metricBuildsTotal = newCounterVec(
+		"esm_builds_total",
+		"The number of the finished builds by status (success, failure or canceled).",
+		"status",
+	)
+	metricBuildsRejected = newCounterVec(
+		"esm_builds_rejected_total",
+		"The number of the rejected build requests by reason (client_limit or queue_full).",
+		"reason",
+	)
+	metricQueueWait = newHistogramVec(
+		"esm_build_queue_wait_seconds",
+		"The waiting time of the builds in the queue before started.",
+		durationBuckets,
+		"priority",
+	)
+	metricNpmFetchDuration = newHistogramVec(
+		"esm_npm_fetch_duration_seconds",
+		"The latency of the package metadata requests to the npm registry.",
+		latencyBuckets,
+	)
+	metricNpmFetchErrors = newCounterVec(
+		"esm_npm_fetch_errors_total",
+		"The number of the failed package metadata requests to the npm registry.",
+	)
+	metricCacheRequests = newCounterVec(
+		"esm_cache_requests_total",
+		"The number of the cache lookups by result (hit or miss), the `build` cache is the build storage.",
+		"cache", "result",
+	)
+	metricSubprocessDuration = newHistogramVec(
+		"esm_subprocess_duration_seconds",
+		"The duration of the subprocesses (pnpm_install or cjs_lexer).",
+		durationBuckets,
+		"command",
+	)
+	metricHttpResponses = newCounterVec(
+		"esm_http_responses_total",
+		"The number of the http responses by route class and status code.",
+		"route", "code",
+	)
+	metricHttpDuration = newHistogramVec(
+		"esm_http_response_duration_seconds",
+		"The duration of the http responses by route class.",
+		latencyBuckets,
+		"route",
+	)
+)
+
+// the metrics that are written to the `/metrics` endpoint in order
+var registeredMetrics = []metricWriter{
+	metricBuildDuration,
+	metricBuildStageDuration,
+	metricBuildsTotal,
+	metricBuildsRejected,
+	metricQueueWait,
+	metricNpmFetchDuration,
+	metricNpmFetchErrors,
+	metricCacheRequests,
+	metricSubprocessDuration,
+	metricHttpResponses,
+	metricHttpDuration,
+}
+
+type metricWriter interface {
+	writeTo(w io.Writer)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// Inc increases the counter of the label values by 1.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // the counts of the buckets, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// Observe adds the value to the histogram of the label values.
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// ObserveSince adds the seconds since the start time to the histogram of the label values.
+func (h *histogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var n uint64
+		for i, le := range h.buckets {
+			n += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatFloat(le)), n)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+// formatLabels formats the labels like `{stage="build",target="es2022"}`, the `le` label is added
+// if it's not empty.
+func formatLabels(labels []string, key string, le string) string {
+	pairs := []string{}
+	if len(labels) > 0 {
+		for i, value := range strings.SplitN(key, "\xff", len(labels)) {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabelValue(value)))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeQueueMetrics writes the gauges of the build queue.
+func writeQueueMetrics(w io.Writer, q *BuildQueue) {
+	q.lock.RLock()
+	pending := map[BuildPriority]int{}
+	local, remote := 0, 0
+	for el := q.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*queueTask)
+		if ok && !t.inProcess {
+			pending[t.priority()]++
+		}
+	}
+	for _, t := range q.processes {
+		if t.worker != "" {
+			remote++
+		} else {
+			local++
+		}
+	}
+	q.lock.RUnlock()
+
+	fmt.Fprint(w, "# HELP esm_build_queue_depth The number of the pending builds in the queue by priority.\n# TYPE esm_build_queue_depth gauge\n")
+	for _, p := range []BuildPriority{PriorityInteractive, PriorityBackground, PriorityPrewarm} {
+		fmt.Fprintf(w, "esm_build_queue_depth{priority=\"%s\"} %d\n", p, pending[p])
+	}
+	fmt.Fprint(w, "# HELP esm_build_queue_processes The number of the builds in process.\n# TYPE esm_build_queue_processes gauge\n")
+	fmt.Fprintf(w, "esm_build_queue_processes{location=\"local\"} %d\n", local)
+	fmt.Fprintf(w, "esm_build_queue_processes{location=\"remote\"} %d\n", remote)
+}
+
+// buildStatus returns the status label of the build error.
+func buildStatus(err error) string {
+	if err == nil {
+		return "success"
+	}
+	if isCanceled(err) {
+		return "canceled"
+	}
+	return "failure"
+}
+
+// getRouteClass returns the route class of the request path for the http metrics.
+func getRouteClass(method string, pathname string) string {
+	if cfg.CdnBasePath != "" {
+		pathname = strings.TrimPrefix(pathname, cfg.CdnBasePath)
+	}
+	switch {
+	case pathname == "/metrics":
+		return "metrics"
+	case strings.HasPrefix(pathname, "/_"), method == "POST":
+		return "api"
+	case pathname == "/", pathname == "/status.json", pathname == "/favicon.ico", pathname == "/robots.txt",
+		strings.HasPrefix(pathname, "/embed/"), strings.HasPrefix(pathname, "/error.js"):
+		return "static"
+	case endsWith(pathname, ".d.ts", ".d.mts"):
+		return "types"
+	case strings.HasPrefix(pathname, "/stable/"), regexpBuildVersionPath.MatchString(pathname):
+		return "build"
+	default:
+		return "module"
+	}
+}
+
+// metricsAccessLogger records the http metrics from the access log entries of the router.
+type metricsAccessLogger struct {
+	logger rex.Logger
+}
+
+// Printf is called by the router with the args:
+// remoteIP, host, proto, method, requestURI, contentLength, referer, userAgent, status, written, ms
+func (l *metricsAccessLogger) Printf(format string, v ...interface{}) {
+	if len(v) == 11 {
+		method, _ := v[3].(string)
+		uri, _ := v[4].(string)
+		status, _ := v[8].(int)
+		ms, _ := v[10].(time.Duration)
+		pathname, _ := utils.SplitByFirstByte(uri, '?')
+		route := getRouteClass(method, pathname)
+		metricHttpResponses.Inc(route, strconv.Itoa(status))
+		metricHttpDuration.Observe(float64(ms)/1000, route)
+	}
+	if l.logger != nil {
+		l.logger.Printf(format, v...)
+	}
+}
+
+// metricsHandler handles the `GET /metrics` requests, it requires the metrics token or the auth secret.
+func metricsHandler(ctx *rex.Context) interface{} {
+	if cfg.MetricsToken == "" && cfg.AuthSecret == "" {
+		return rex.Err(403, "forbidden")
+	}
+	if !hasBearerToken(ctx, cfg.MetricsToken, cfg.AuthSecret) {
+		return rex.Status(401, "Unauthorized")
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for _, m := range registeredMetrics {
+		m.writeTo(buf)
+	}
+	writeQueueMetrics(buf, buildQueue)
+	header := ctx.W.Header()
+	header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	return rex.Status(http.StatusOK, buf.Bytes())
+}
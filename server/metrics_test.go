@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	c := newCounterVec("test_requests_total", "The test requests.", "route", "code")
+	c.Inc("module", "200")
+	c.Inc("module", "200")
+	c.Inc("api", "40\"4")
+	h := newHistogramVec("test_duration_seconds", "The test durations.", []float64{0.1, 1}, "stage")
+	h.Observe(0.05, "build")
+	h.Observe(0.5, "build")
+	h.Observe(5, "build")
+
+	buf := bytes.NewBuffer(nil)
+	c.writeTo(buf)
+	h.writeTo(buf)
+	expected := strings.Join([]string{
+		"# HELP test_requests_total The test requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="api",code="40\"4"} 1`,
+		`test_requests_total{route="module",code="200"} 2`,
+		"# HELP test_duration_seconds The test durations.",
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{stage="build",le="0.1"} 1`,
+		`test_duration_seconds_bucket{stage="build",le="1"} 2`,
+		`test_duration_seconds_bucket{stage="build",le="+Inf"} 3`,
+		`test_duration_seconds_sum{stage="build"} 5.55`,
+		`test_duration_seconds_count{stage="build"} 3`,
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Fatalf("unexpected metrics output:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	e := newCounterVec("test_errors_total", "The test errors.")
+	e.Inc()
+	e.writeTo(buf)
+	if !strings.HasSuffix(buf.String(), "\ntest_errors_total 1\n") {
+		t.Fatalf("unexpected metrics output:\n%s", buf.String())
+	}
+}
+
+func TestQueueMetrics(t *testing.T) {
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+	q.Add(&BuildTask{Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022", id: "foo"}, BuildClient{IP: "1.1.1.1"})
+	q.AddWithPriority(&BuildTask{Pkg: Pkg{Name: "bar", Version: "1.0.0"}, Target: "es2022", id: "bar"}, BuildClient{}, PriorityPrewarm)
+	if l := q.LeaseTask("worker-1", time.Minute); l == nil {
+		t.Fatal("expected a lease")
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writeQueueMetrics(buf, q)
+	for _, line := range []string{
+		`esm_build_queue_depth{priority="interactive"} 0`,
+		`esm_build_queue_depth{priority="prewarm"} 1`,
+		`esm_build_queue_processes{location="local"} 0`,
+		`esm_build_queue_processes{location="remote"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("expected '%s' in the metrics:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestRouteClass(t *testing.T) {
+	cfg = &config.Config{}
+	for pathname, route := range map[string]string{
+		"/":              "static",
+		"/embed/test.js": "static",
+		"/metrics":       "metrics",
+		"/_events":       "api",
+		"/_build/stable/react@18.2.0/es2022/react.mjs": "api",
+		"/react@18.2.0":                         "module",
+		"/v135/react@18.2.0/es2022/react.mjs":   "build",
+		"/stable/react@18.2.0/es2022/react.mjs": "build",
+		"/v135/@types/react@18.2.0/index.d.ts":  "types",
+	} {
+		if r := getRouteClass("GET", pathname); r != route {
+			t.Fatalf("expected the route class of '%s' to be '%s', but got '%s'", pathname, route, r)
+		}
+	}
+	if r := getRouteClass("POST", "/build"); r != "api" {
+		t.Fatalf("expected the route class of 'POST /build' to be 'api', but got '%s'", r)
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	cfg = &config.Config{MetricsToken: "token"}
+	buildQueue = newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+	defer func() { buildQueue = nil }()
+
+	request := func(authorization string) interface{} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return metricsHandler(&rex.Context{W: httptest.NewRecorder(), R: r})
+	}
+
+	for _, a := range []string{"", "Bearer ", "Bearer", "Bearer tok", "token"} {
+		if res := request(a); !reflect.DeepEqual(res, rex.Status(401, "Unauthorized")) {
+			t.Fatalf("expected 401 of the authorization '%s', got %v", a, res)
+		}
+	}
+	if res := request("Bearer token"); reflect.DeepEqual(res, rex.Status(401, "Unauthorized")) {
+		t.Fatal("expected the metrics of the valid token")
+	}
+
+	cfg.AuthSecret = "secret"
+	for _, a := range []string{"Bearer token", "Bearer secret"} {
+		if res := request(a); reflect.DeepEqual(res, rex.Status(401, "Unauthorized")) {
+			t.Fatalf("expected the metrics of the authorization '%s'", a)
+		}
+	}
+	if res := request("Bearer "); !reflect.DeepEqual(res, rex.Status(401, "Unauthorized")) {
+		t.Fatal("expected 401 of the empty bearer token")
+	}
+}
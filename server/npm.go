@@ -1,6 +1,8 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -172,6 +174,11 @@ func (a *NpmPackageInfo) UnmarshalJSON(b []byte) error {
 }
 
 func getPackageInfo(wd string, name string, version string) (info NpmPackageInfo, fromPackageJSON bool, err error) {
+	return getPackageInfoContext(context.Background(), wd, name, version)
+}
+
+// getPackageInfoContext is like getPackageInfo, the npm registry request is traced in the context.
+func getPackageInfoContext(ctx context.Context, wd string, name string, version string) (info NpmPackageInfo, fromPackageJSON bool, err error) {
 	if name == "@types/node" {
 		info = NpmPackageInfo{
 			Name:    "@types/node",
@@ -184,20 +191,20 @@ func getPackageInfo(wd string, name string, version string) (info NpmPackageInfo
 	if wd != "" {
 		pkgJsonPath := path.Join(wd, "node_modules", name, "package.json")
 		if fileExists(pkgJsonPath) && utils.ParseJSONFile(pkgJsonPath, &info) == nil {
-			info, err = fixPkgVersion(info)
+			info, err = fixPkgVersion(ctx, info)
 			fromPackageJSON = true
 			return
 		}
 	}
 
-	info, err = fetchPackageInfo(name, version)
+	info, err = fetchPackageInfo(ctx, name, version)
 	if err == nil {
-		info, err = fixPkgVersion(info)
+		info, err = fixPkgVersion(ctx, info)
 	}
 	return
 }
 
-func fetchPackageInfo(name string, version string) (info NpmPackageInfo, err error) {
+func fetchPackageInfo(ctx context.Context, name string, version string) (info NpmPackageInfo, err error) {
 	a := strings.Split(strings.Trim(name, "/"), "/")
 	name = a[0]
 	if strings.HasPrefix(name, "@") && len(a) > 1 {
@@ -212,27 +219,65 @@ func fetchPackageInfo(name string, version string) (info NpmPackageInfo, err err
 	}
 	isFullVersion := regexpFullVersion.MatchString(version)
 
+	_, span := startSpan(ctx, "fetchPackageInfo", "name", name, "version", version)
+	defer func() {
+		span.SetAttr("resolved", info.Version)
+		span.End(err)
+	}()
+
 	cacheKey := fmt.Sprintf("npm:%s@%s", name, version)
 	lock := getFetchLock(cacheKey)
 	lock.Lock()
 	defer lock.Unlock()
 
 	// check cache firstly
-	if cache != nil {
-		var data []byte
-		data, err = cache.Get(cacheKey)
+	readCache := func() bool {
+		if cache == nil {
+			return false
+		}
+		data, err := cache.Get(cacheKey)
 		if err == nil && json.Unmarshal(data, &info) == nil {
-			return
+			return true
 		}
 		if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
 			log.Error("cache:", err)
 		}
+		return false
+	}
+	hit := readCache()
+	if !hit {
+		// wait for other instances fetching the same package to share the cache, and check the
+		// cache again after the lease is acquired
+		var lease storage.Lease
+		lease, err = acquireLease(ctx, "fetch:"+cacheKey, 30*time.Second)
+		if err != nil {
+			// the package may be fetched by the lease holder in the meantime
+			if !readCache() {
+				return
+			}
+			err = nil
+			hit = true
+		} else {
+			defer lease.Unlock()
+			hit = readCache()
+		}
+	}
+	if hit {
+		metricCacheRequests.Inc("npm", "hit")
+		span.SetAttr("cache", "hit")
+		return
+	}
+	if cache != nil {
+		metricCacheRequests.Inc("npm", "miss")
 	}
 
 	start := time.Now()
 	defer func() {
+		metricNpmFetchDuration.ObserveSince(start)
 		if err == nil {
 			log.Debugf("lookup package(%s@%s) in %v", name, info.Version, time.Since(start))
+		} else {
+			metricNpmFetchErrors.Inc()
 		}
 	}()
 
@@ -260,6 +305,7 @@ func fetchPackageInfo(name string, version string) (info NpmPackageInfo, err err
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
+		err = asTransientError(err)
 		return
 	}
 	defer resp.Body.Close()
@@ -276,6 +322,10 @@ func fetchPackageInfo(name string, version string) (info NpmPackageInfo, err err
 	if resp.StatusCode != 200 {
 		ret, _ := io.ReadAll(resp.Body)
 		err = fmt.Errorf("npm: could not get metadata of package '%s' (%s: %s)", name, resp.Status, string(ret))
+		// the registry is overloaded or unavailable
+		if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+			err = asTransientError(err)
+		}
 		return
 	}
 
@@ -308,7 +358,7 @@ func fetchPackageInfo(name string, version string) (info NpmPackageInfo, err err
 		var c *semver.Constraints
 		c, err = semver.NewConstraint(version)
 		if err != nil && version != "latest" {
-			return fetchPackageInfo(name, "latest")
+			return fetchPackageInfo(ctx, name, "latest")
 		}
 		vs := make([]*semver.Version, len(h.Versions))
 		i := 0
@@ -348,14 +398,33 @@ func fetchPackageInfo(name string, version string) (info NpmPackageInfo, err err
 	return
 }
 
-func installPackage(wd string, pkg Pkg) (err error) {
+func installPackage(ctx context.Context, wd string, pkg Pkg) (err error) {
 	pkgVersionName := pkg.VersionName()
 
+	ctx, span := startSpan(ctx, "installPackage", "pkg", pkgVersionName)
+	defer func() {
+		span.End(err)
+	}()
+
 	// only one install process allowed at the same time
 	lock := getInstallLock(pkgVersionName)
 	lock.Lock()
 	defer lock.Unlock()
 
+	// wait for the install of another instance until the deadline of the install
+	leaseTimeout := maxLeaseWait
+	if deadline, ok := ctx.Deadline(); ok {
+		leaseTimeout = time.Until(deadline)
+	}
+	lease, err := acquireLease(ctx, "install:"+pkgVersionName, leaseTimeout)
+	if err != nil {
+		return
+	}
+	defer lease.Unlock()
+
+	// update the last access time of the install directory for the gc
+	touchDir(wd)
+
 	// ensure package.json file to prevent read up-levels
 	packageFilePath := path.Join(wd, "package.json")
 	if pkg.FromEsmsh {
@@ -378,7 +447,7 @@ func installPackage(wd string, pkg Pkg) (err error) {
 
 	for i := 0; i < 3; i++ {
 		if pkg.FromEsmsh {
-			err = pnpmInstall(wd)
+			err = pnpmInstall(ctx, wd)
 			if err == nil {
 				installDir := path.Join(wd, "node_modules", pkg.Name)
 				for _, name := range []string{"package.json", "index.mjs", "index.d.ts"} {
@@ -389,15 +458,15 @@ func installPackage(wd string, pkg Pkg) (err error) {
 				}
 			}
 		} else if pkg.FromGithub {
-			err = pnpmInstall(wd)
+			err = pnpmInstall(ctx, wd)
 			// pnpm will ignore github package which has been installed without `package.json` file
 			if err == nil && !dirExists(path.Join(wd, "node_modules", pkg.Name)) {
 				err = ghInstall(wd, pkg.Name, pkg.Version)
 			}
 		} else if regexpFullVersion.MatchString(pkg.Version) {
-			err = pnpmInstall(wd, pkgVersionName, "--prefer-offline")
+			err = pnpmInstall(ctx, wd, pkgVersionName, "--prefer-offline")
 		} else {
-			err = pnpmInstall(wd, pkgVersionName)
+			err = pnpmInstall(ctx, wd, pkgVersionName)
 		}
 		packageFilePath := path.Join(wd, "node_modules", pkg.Name, "package.json")
 		if err == nil && !fileExists(packageFilePath) {
@@ -408,7 +477,7 @@ func installPackage(wd string, pkg Pkg) (err error) {
 				err = fmt.Errorf("pnpm install %s: package.json not found", pkg)
 			}
 		}
-		if err == nil {
+		if err == nil || ctx.Err() != nil {
 			break
 		}
 		if i < 2 {
@@ -418,7 +487,27 @@ func installPackage(wd string, pkg Pkg) (err error) {
 	return
 }
 
-func pnpmInstall(wd string, packages ...string) (err error) {
+// the error codes of pnpm that the packages can't be fetched from the registry
+var pnpmFetchErrorCodes = []string{
+	"ERR_PNPM_FETCH",
+	"ERR_PNPM_META_FETCH_FAIL",
+	"ECONNRESET",
+	"ETIMEDOUT",
+	"EAI_AGAIN",
+}
+
+// isPnpmFetchError checks if the pnpm output is the error of fetching the packages, the install
+// may succeed if it's retried later.
+func isPnpmFetchError(output string) bool {
+	for _, code := range pnpmFetchErrorCodes {
+		if strings.Contains(output, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func pnpmInstall(ctx context.Context, wd string, packages ...string) (err error) {
 	var args []string
 	if len(packages) > 0 {
 		args = append([]string{"add"}, packages...)
@@ -446,9 +535,21 @@ func pnpmInstall(wd string, packages ...string) (err error) {
 			"ESM_NPM_PASSWORD="+string(password),
 		)
 	}
-	output, err := cmd.CombinedOutput()
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err = runCommand(ctx, cmd)
+	metricSubprocessDuration.ObserveSince(start, "pnpm_install")
+	getBuildLog(ctx).Output(fmt.Sprintf("pnpm %s (%v)", strings.Join(args, " "), time.Since(start)), output.Bytes())
 	if err != nil {
-		return fmt.Errorf("pnpm add %s: %s", strings.Join(packages, ","), string(output))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = fmt.Errorf("pnpm add %s: %s", strings.Join(packages, ","), output.String())
+		if isPnpmFetchError(output.String()) {
+			err = asTransientError(err)
+		}
+		return err
 	}
 	if len(packages) > 0 {
 		log.Debug("pnpm add", strings.Join(packages, ","), "in", time.Since(start))
@@ -480,10 +581,10 @@ func toTypesPackageName(pkgName string) string {
 	return "@types/" + pkgName
 }
 
-func fixPkgVersion(info NpmPackageInfo) (NpmPackageInfo, error) {
+func fixPkgVersion(ctx context.Context, info NpmPackageInfo) (NpmPackageInfo, error) {
 	for prefix, ver := range fixedPkgVersions {
 		if strings.HasPrefix(info.Name+"@"+info.Version, prefix) {
-			return fetchPackageInfo(info.Name, ver)
+			return fetchPackageInfo(ctx, info.Name, ver)
 		}
 	}
 	return info, nil
@@ -502,3 +603,23 @@ func getFetchLock(key string) *sync.Mutex {
 	v, _ := fetchLocks.LoadOrStore(key, &sync.Mutex{})
 	return v.(*sync.Mutex)
 }
+
+// the ttl of the leases, the leases are kept alive by the holder until unlocked
+const leaseTTL = 30 * time.Second
+
+// the max time to wait for the lease held by another instance if the caller has no deadline,
+// e.g. the build or the install timeout is no limit
+const maxLeaseWait = 10 * time.Minute
+
+// acquireLease acquires the cluster-wide lease of the key, it gives up when the context is done or
+// the timeout is exceeded, the callers must not go ahead without the lease.
+func acquireLease(ctx context.Context, key string, timeout time.Duration) (storage.Lease, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	lease, err := locker.Lock(ctx, key, leaseTTL)
+	if err != nil {
+		return nil, fmt.Errorf("lock(%s): %w", key, err)
+	}
+	return lease, nil
+}
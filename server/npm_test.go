@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+type countingLocker struct {
+	storage.Locker
+	locks int
+}
+
+func (l *countingLocker) Lock(ctx context.Context, key string, ttl time.Duration) (storage.Lease, error) {
+	l.locks++
+	return l.Locker.Lock(ctx, key, ttl)
+}
+
+func TestFetchPackageInfoCached(t *testing.T) {
+	var err error
+	cfg = &config.Config{}
+	cache, err = storage.OpenCache("memory:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { cache = nil }()
+	l := &countingLocker{Locker: storage.NewMemoryLocker()}
+	defaultLocker := locker
+	locker = l
+	defer func() { locker = defaultLocker }()
+
+	cache.Set("npm:foo@1.0.0", utils.MustEncodeJSON(NpmPackageInfo{Name: "foo", Version: "1.0.0"}), time.Hour)
+	info, err := fetchPackageInfo(context.Background(), "foo", "1.0.0")
+	if err != nil || info.Version != "1.0.0" {
+		t.Fatalf("unexpected package info %+v, %v", info, err)
+	}
+	// the cache hit doesn't take the cluster-wide lease
+	if l.locks != 0 {
+		t.Fatalf("expected no lease of the cache hit, got %d", l.locks)
+	}
+}
+
+func TestAcquireLeaseCanceled(t *testing.T) {
+	defaultLocker := locker
+	locker = storage.NewMemoryLocker()
+	defer func() { locker = defaultLocker }()
+
+	lease, err := acquireLease(context.Background(), "install:foo@1.0.0", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Unlock()
+
+	// the waiting caller gives up when its context is done instead of going ahead without the lease
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = acquireLease(ctx, "install:foo@1.0.0", time.Minute)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the canceled error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("the cancellation is not respected")
+	}
+
+	// gives up after the timeout
+	_, err = acquireLease(context.Background(), "install:foo@1.0.0", 100*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the timeout error, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+var errInvalidBuildID = errors.New("invalid build id")
+
+// getPrefetchDepth returns the depth of the dependency graph to prefetch for the request,
+// the `?prefetch=N` query can't exceed the configured depth.
+func getPrefetchDepth(ctx *rex.Context) int {
+	depth := cfg.Prefetch.Depth
+	if ctx.Form.Has("prefetch") {
+		if n, err := strconv.Atoi(ctx.Form.Value("prefetch")); err == nil && n >= 0 && n < depth {
+			depth = n
+		}
+		return depth
+	}
+	if cfg.Prefetch.Enabled {
+		return depth
+	}
+	return 0
+}
+
+// prefetch enqueues the background builds of the deps of the build. The deps that are already
+// built are walked through to prefetch their deps in the depth.
+func (q *BuildQueue) prefetch(task *BuildTask, meta *ESMBuild, depth int) {
+	q.prefetchDeps(task, meta, depth, newStringSet(task.ID()))
+}
+
+func (q *BuildQueue) prefetchDeps(task *BuildTask, meta *ESMBuild, depth int, visited *stringSet) {
+	for _, dep := range meta.Deps {
+		id, ok := depBuildID(dep)
+		if !ok || visited.Has(id) {
+			continue
+		}
+		visited.Add(id)
+		if esm, ok := queryESMBuild(id); ok {
+			if depth > 1 {
+				q.prefetchDeps(task, esm, depth-1, visited)
+			}
+			continue
+		}
+		if _, failed := getBuildFailure(id); failed {
+			continue
+		}
+		depTask, err := parseBuildID(id)
+		if err != nil {
+			log.Debugf("prefetch: can't build '%s' from the id", id)
+			continue
+		}
+		if depTask.ID() != id {
+			log.Warnf("prefetch: the id of the parsed task '%s' doesn't match '%s'", depTask.ID(), id)
+			continue
+		}
+		depTask.CdnOrigin = task.CdnOrigin
+		depTask.Prefetch = depth - 1
+		q.AddWithPriority(depTask, BuildClient{}, PriorityBackground)
+	}
+}
+
+// depBuildID returns the build id of the dep import path, e.g. `/v135/react@18.2.0/es2022/react.mjs`.
+func depBuildID(dep string) (id string, ok bool) {
+	if !strings.HasPrefix(dep, cfg.CdnBasePath+"/") || strings.ContainsRune(dep, '?') {
+		return
+	}
+	id = strings.TrimPrefix(dep, cfg.CdnBasePath+"/")
+	if !(strings.HasPrefix(id, "stable/") || regexpBuildVersionPath.MatchString("/"+id)) || !endsWith(id, ".mjs", ".js") {
+		return "", false
+	}
+	return id, true
+}
+
+// parseBuildID returns the build task of the build id as the `esmHandler` does for the
+// build path, it's the reverse of `BuildTask.ID()`.
+func parseBuildID(id string) (*BuildTask, error) {
+	buildVersion := VERSION
+	v, pathname := utils.SplitByFirstByte(id, '/')
+	if v != "stable" {
+		n, err := strconv.Atoi(strings.TrimPrefix(v, "v"))
+		if err != nil || !strings.HasPrefix(v, "v") || n <= 0 || n > VERSION {
+			return nil, errInvalidBuildID
+		}
+		buildVersion = n
+	}
+	if !endsWith(pathname, ".mjs", ".js") {
+		return nil, errInvalidBuildID
+	}
+	pkg, _, err := validatePkgPath("/" + pathname)
+	if err != nil {
+		return nil, err
+	}
+
+	args := BuildArgs{
+		alias:          map[string]string{},
+		deps:           PkgSlice{},
+		conditions:     newStringSet(),
+		external:       newStringSet(),
+		exports:        newStringSet(),
+		denoStdVersion: denoStdVersion,
+		ignoreRequire:  pkg.Name == "@unocss/preset-icons",
+	}
+	prefixArgs, ok, err := splitBuildArgsPrefix(&pkg)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		args = prefixArgs
+	}
+	bp, ok := parseBuildPath(pkg)
+	if !ok || !strings.Contains(pkg.SubModule, "/") {
+		return nil, errInvalidBuildID
+	}
+	pkg.SubModule = bp.entrySubmodule(pkg)
+	return &BuildTask{
+		Args:         args,
+		Pkg:          pkg,
+		BuildVersion: buildVersion,
+		Target:       bp.target,
+		BundleDeps:   bp.bundleDeps,
+		NoBundle:     bp.noBundle,
+		Dev:          bp.dev,
+	}, nil
+}
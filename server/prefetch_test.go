@@ -0,0 +1,115 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/gox/utils"
+)
+
+func TestParseBuildID(t *testing.T) {
+	cfg = &config.Config{}
+
+	newArgs := func() BuildArgs {
+		return BuildArgs{
+			alias:          map[string]string{},
+			deps:           PkgSlice{},
+			conditions:     newStringSet(),
+			external:       newStringSet(),
+			exports:        newStringSet(),
+			denoStdVersion: denoStdVersion,
+		}
+	}
+	aliasArgs := newArgs()
+	aliasArgs.alias["react"] = "preact/compat"
+
+	for _, task := range []*BuildTask{
+		{Pkg: Pkg{Name: "react", Version: "18.2.0"}, Target: "es2022"},
+		{Pkg: Pkg{Name: "react", Version: "18.2.0"}, Target: "deno", Dev: true},
+		{Pkg: Pkg{Name: "react-dom", Version: "18.2.0", SubModule: "client", SubPath: "client"}, Target: "es2022"},
+		{Pkg: Pkg{Name: "react-dom", Version: "18.2.0", SubModule: "server", SubPath: "server"}, Target: "es2020", NoBundle: true},
+		{Pkg: Pkg{Name: "swr", Version: "2.2.4"}, Target: "es2022", Args: aliasArgs, BundleDeps: true},
+		{Pkg: Pkg{Name: "@babel/core", Version: "7.23.0"}, Target: "node", BuildVersion: 120},
+	} {
+		if task.BuildVersion == 0 {
+			task.BuildVersion = VERSION
+		}
+		if task.Args.alias == nil {
+			task.Args = newArgs()
+		}
+		id := task.ID()
+		parsed, err := parseBuildID(id)
+		if err != nil {
+			t.Fatalf("parseBuildID(%s): %v", id, err)
+		}
+		if parsed.ID() != id {
+			t.Fatalf("expected the id of the parsed task to be '%s', but got '%s'", id, parsed.ID())
+		}
+		if parsed.Dev != task.Dev || parsed.BundleDeps != task.BundleDeps || parsed.NoBundle != task.NoBundle || parsed.Pkg.SubModule != task.Pkg.SubModule {
+			t.Fatalf("unexpected task of '%s': %+v", id, parsed)
+		}
+	}
+
+	for _, id := range []string{
+		"v135/react@18.2.0/es2022/react.d.ts",
+		"v135/react@18.2.0/react.mjs",
+		"v999/react@18.2.0/es2022/react.mjs",
+		"react@18.2.0/es2022/react.mjs",
+	} {
+		if _, err := parseBuildID(id); err == nil {
+			t.Fatalf("expected the id '%s' to be invalid", id)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	setupTestStorage(t)
+	cfg.CdnBasePath = ""
+
+	// the built dep `scheduler` is walked through to prefetch its deps
+	scheduler := "v135/scheduler@0.23.0/es2022/scheduler.mjs"
+	if _, err := fs.WriteFile("builds/"+scheduler, strings.NewReader("export {}")); err != nil {
+		t.Fatal(err)
+	}
+	esm := &ESMBuild{Deps: []string{"/v135/loose-envify@1.4.0/es2022/loose-envify.mjs", "/stable/react@18.2.0/es2022/react.mjs"}}
+	if err := db.Put(scheduler, utils.MustEncodeJSON(esm)); err != nil {
+		t.Fatal(err)
+	}
+
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+	parent := &BuildTask{
+		Args:         BuildArgs{external: newStringSet(), exports: newStringSet(), conditions: newStringSet()},
+		Pkg:          Pkg{Name: "react-dom", Version: "18.2.0"},
+		Target:       "es2022",
+		BuildVersion: VERSION,
+		CdnOrigin:    "https://esm.sh",
+	}
+	meta := &ESMBuild{Deps: []string{
+		"/stable/react@18.2.0/es2022/react.mjs",
+		"/stable/react@18.2.0/es2022/react.mjs",
+		"/" + scheduler,
+		"/v135/node_process.js",
+		"/error.js?type=unsupported-node-builtin-module&name=fs",
+		"https://deno.land/std@0.177.1/node/fs.ts",
+	}}
+	q.prefetch(parent, meta, 2)
+
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 prefetch tasks, but got %d", q.Len())
+	}
+	react := q.tasks["stable/react@18.2.0/es2022/react.mjs"]
+	if react == nil || react.Prefetch != 1 || react.CdnOrigin != "https://esm.sh" || react.priority() != PriorityBackground {
+		t.Fatalf("unexpected prefetch task of react: %+v", react)
+	}
+	if dep := q.tasks["v135/loose-envify@1.4.0/es2022/loose-envify.mjs"]; dep == nil || dep.Prefetch != 0 {
+		t.Fatal("the dep of the built dep should be prefetched")
+	}
+
+	// the deps of the built deps are not walked in the depth of 1
+	q = newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+	q.prefetch(parent, meta, 1)
+	if q.Len() != 1 || !q.Has("stable/react@18.2.0/es2022/react.mjs") {
+		t.Fatalf("expected only react to be prefetched, but got %d tasks", q.Len())
+	}
+}
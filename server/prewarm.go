@@ -0,0 +1,531 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+const (
+	// the interval of checking the progress of the queued prewarm builds
+	prewarmCheckInterval = 2 * time.Second
+	// the number of the finished prewarm jobs to keep for the status requests
+	prewarmJobsLimit = 10
+	// the days of the access logs to replay
+	prewarmReplayDays = 7
+)
+
+// the line of the access log: `{date} {time} {ip} {host} {proto} {method} {uri} {contentLength} {referer} "{ua}" {status} {written} {ms}ms`
+var regexpAccessLogLine = regexp.MustCompile(`^\S+ \S+ \S+ \S+ \S+ (\S+) (\S+) \S+ \S+ "((?:[^"\\]|\\.)*)" (\d+) \d+ \d+ms$`)
+
+var (
+	prewarmLock sync.Mutex
+	prewarmJobs []*prewarmJob
+)
+
+// PrewarmInput is the input of a prewarm job, the builds of the packages are prewarmed for
+// every target, and the development and bundle builds are added if the flags are set.
+type PrewarmInput struct {
+	Packages  []string `json:"packages"`
+	Targets   []string `json:"targets"`
+	Dev       bool     `json:"dev"`
+	Bundle    bool     `json:"bundle"`
+	Replay    int      `json:"replay"` // replays the top N module requests of the access log
+	CdnOrigin string   `json:"cdnOrigin"`
+}
+
+// PrewarmReport is the progress of a prewarm job.
+type PrewarmReport struct {
+	ID        string           `json:"id"`
+	StartedAt time.Time        `json:"startedAt"`
+	Duration  string           `json:"duration"`
+	Done      bool             `json:"done"`
+	Total     int              `json:"total"`
+	Cached    int              `json:"cached"`
+	Pending   int              `json:"pending"`
+	Built     int              `json:"built"`
+	Failed    int              `json:"failed"`
+	Failures  []PrewarmFailure `json:"failures"`
+}
+
+// PrewarmFailure is a build that can't be prewarmed.
+type PrewarmFailure struct {
+	prewarmItem
+	Error string `json:"error"`
+}
+
+func (r *PrewarmReport) String() string {
+	return fmt.Sprintf(
+		"%d/%d builds prewarmed in %s, %d cached, %d built, %d failed, %d pending",
+		r.Cached+r.Built,
+		r.Total,
+		r.Duration,
+		r.Cached,
+		r.Built,
+		r.Failed,
+		r.Pending,
+	)
+}
+
+type prewarmItem struct {
+	Spec   string `json:"spec"`
+	Target string `json:"target"`
+	Dev    bool   `json:"dev,omitempty"`
+	Bundle bool   `json:"bundle,omitempty"`
+}
+
+func (item prewarmItem) String() string {
+	flags := []string{item.Target}
+	if item.Dev {
+		flags = append(flags, "dev")
+	}
+	if item.Bundle {
+		flags = append(flags, "bundle")
+	}
+	return fmt.Sprintf("%s (%s)", item.Spec, strings.Join(flags, ", "))
+}
+
+// task returns the build task of the item as the `esmHandler` does for the bare module request.
+func (item prewarmItem) task(cdnOrigin string) (*BuildTask, error) {
+	if targets[item.Target] == 0 {
+		return nil, fmt.Errorf("invalid target '%s'", item.Target)
+	}
+	pkg, _, err := validatePkgPath("/" + strings.TrimPrefix(item.Spec, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(item.Target, "es") && includes(nativeNodePackages, pkg.Name) {
+		return nil, fmt.Errorf("unsupported npm package \"%s\": native node module is not supported in browser", pkg.Name)
+	}
+	dev := item.Dev
+	if (pkg.Name == "react" && pkg.SubModule == "jsx-dev-runtime") || pkg.Name == "react-refresh" {
+		dev = true
+	}
+	return &BuildTask{
+		Args: BuildArgs{
+			alias:          map[string]string{},
+			deps:           PkgSlice{},
+			conditions:     newStringSet(),
+			external:       newStringSet(),
+			exports:        newStringSet(),
+			denoStdVersion: denoStdVersion,
+			ignoreRequire:  pkg.Name == "@unocss/preset-icons",
+		},
+		CdnOrigin:    cdnOrigin,
+		BuildVersion: VERSION,
+		Pkg:          pkg,
+		Target:       item.Target,
+		Dev:          dev,
+		BundleDeps:   item.Bundle,
+	}, nil
+}
+
+// prewarmItems returns the builds of the packages × targets × dev/bundle flags.
+func prewarmItems(input PrewarmInput) []prewarmItem {
+	targets := input.Targets
+	if len(targets) == 0 {
+		targets = []string{"es2022"}
+	}
+	devs := []bool{false}
+	if input.Dev {
+		devs = append(devs, true)
+	}
+	bundles := []bool{false}
+	if input.Bundle {
+		bundles = append(bundles, true)
+	}
+	items := []prewarmItem{}
+	for _, spec := range input.Packages {
+		spec = strings.TrimPrefix(strings.TrimSpace(spec), "/")
+		if spec == "" {
+			continue
+		}
+		for _, target := range targets {
+			for _, dev := range devs {
+				for _, bundle := range bundles {
+					items = append(items, prewarmItem{Spec: spec, Target: strings.ToLower(target), Dev: dev, Bundle: bundle})
+				}
+			}
+		}
+	}
+	return items
+}
+
+// readAccessLog counts the module requests of the access log. Only the `target`, `dev` and
+// `bundle` queries are replayed, the target is resolved by the user agent if the request has
+// no `target` query.
+func readAccessLog(r io.Reader, counts map[prewarmItem]int) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		m := regexpAccessLogLine.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		method, uri, ua := m[1], m[2], strings.ReplaceAll(m[3], `\"`, `"`)
+		status, _ := strconv.Atoi(m[4])
+		if (method != "GET" && method != "HEAD") || status >= 400 {
+			continue
+		}
+		item, ok := parseModuleRequest(uri, ua)
+		if ok {
+			counts[item]++
+		}
+	}
+	return scanner.Err()
+}
+
+// parseModuleRequest parses the request uri of a bare module, e.g. `/react@18.2.0?target=es2022&dev`.
+func parseModuleRequest(uri string, ua string) (item prewarmItem, ok bool) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return
+	}
+	pathname := u.Path
+	if cfg.CdnBasePath != "" {
+		pathname = strings.TrimPrefix(pathname, cfg.CdnBasePath)
+	}
+	if pathname == "/" || strings.HasPrefix(pathname, "/_") || strings.HasPrefix(pathname, "/~") ||
+		strings.HasPrefix(pathname, "/stable/") || regexpBuildVersionPath.MatchString(pathname) ||
+		endsWith(pathname, ".d.ts", ".d.mts", ".css", ".map", ".json", ".wasm", ".html", ".txt", ".ico") {
+		return
+	}
+	switch pathname {
+	case "/build", "/run", "/hot", "/server", "/error.js", "/esma-target":
+		return
+	}
+	pkgName, _, _ := splitPkgPath(strings.TrimPrefix(pathname, "/gh"))
+	if !strings.HasPrefix(pathname, "/gh/") && !validatePackageName(pkgName) {
+		return
+	}
+	query := u.Query()
+	if query.Has("pin") {
+		return
+	}
+	target := strings.ToLower(query.Get("target"))
+	if targets[target] == 0 {
+		target = getBuildTargetByUA(ua)
+	}
+	return prewarmItem{
+		Spec:   strings.TrimPrefix(pathname, "/"),
+		Target: target,
+		Dev:    query.Has("dev"),
+		Bundle: query.Has("bundle") || query.Has("standalone") || query.Has("bundle-deps"),
+	}, true
+}
+
+func topPrewarmItems(counts map[prewarmItem]int, n int) []prewarmItem {
+	items := make([]prewarmItem, 0, len(counts))
+	for item := range counts {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+		if a.Spec != b.Spec {
+			return a.Spec < b.Spec
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return !a.Dev && b.Dev || a.Dev == b.Dev && !a.Bundle && b.Bundle
+	})
+	if n > 0 && len(items) > n {
+		items = items[:n]
+	}
+	return items
+}
+
+// replayAccessLogs returns the top n module requests of the recent access logs in the log dir.
+func replayAccessLogs(logDir string, n int) ([]prewarmItem, error) {
+	files, err := filepath.Glob(path.Join(logDir, "access-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	since := time.Now().AddDate(0, 0, -prewarmReplayDays).Format("20060102")
+	counts := map[prewarmItem]int{}
+	for _, name := range files {
+		// access-20060102.log or access-20060102_1.log
+		date, _ := utils.SplitByFirstByte(strings.TrimSuffix(strings.TrimPrefix(path.Base(name), "access-"), ".log"), '_')
+		if date < since {
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		err = readAccessLog(f, counts)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return topPrewarmItems(counts, n), nil
+}
+
+type prewarmJob struct {
+	lock    sync.Mutex
+	report  PrewarmReport
+	pending map[string]prewarmItem
+}
+
+// startPrewarm enqueues the builds at the prewarm priority, the builds that are already in the
+// storage or in the backoff window of a failure are skipped.
+func startPrewarm(items []prewarmItem, cdnOrigin string) *prewarmJob {
+	j := &prewarmJob{
+		report: PrewarmReport{
+			ID:        strconv.FormatInt(time.Now().UnixNano(), 36),
+			StartedAt: time.Now(),
+			Total:     len(items),
+			Failures:  []PrewarmFailure{},
+		},
+		pending: map[string]prewarmItem{},
+	}
+
+	prewarmLock.Lock()
+	prewarmJobs = append(prewarmJobs, j)
+	if len(prewarmJobs) > prewarmJobsLimit {
+		prewarmJobs = prewarmJobs[len(prewarmJobs)-prewarmJobsLimit:]
+	}
+	prewarmLock.Unlock()
+
+	go j.run(items, cdnOrigin)
+	return j
+}
+
+func getPrewarmJob(id string) *prewarmJob {
+	prewarmLock.Lock()
+	defer prewarmLock.Unlock()
+
+	for _, j := range prewarmJobs {
+		if j.report.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+func (j *prewarmJob) run(items []prewarmItem, cdnOrigin string) {
+	log.Infof("prewarm '%s': %d builds", j.report.ID, len(items))
+	for _, item := range items {
+		// resolving the package version may take a while
+		task, err := item.task(cdnOrigin)
+		if err != nil {
+			j.fail(item, err)
+			continue
+		}
+		id := task.ID()
+		j.lock.Lock()
+		_, dup := j.pending[id]
+		j.lock.Unlock()
+		if dup {
+			j.lock.Lock()
+			j.report.Total--
+			j.lock.Unlock()
+			continue
+		}
+		if _, ok := queryESMBuild(id); ok {
+			j.lock.Lock()
+			j.report.Cached++
+			j.lock.Unlock()
+			continue
+		}
+		if f, failed := getBuildFailure(id); failed {
+			j.fail(item, f.Err())
+			continue
+		}
+		buildQueue.AddWithPriority(task, BuildClient{}, PriorityPrewarm)
+		j.lock.Lock()
+		j.pending[id] = item
+		j.report.Pending++
+		j.lock.Unlock()
+	}
+
+	for {
+		j.lock.Lock()
+		n := len(j.pending)
+		j.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(prewarmCheckInterval)
+		j.check()
+	}
+
+	j.lock.Lock()
+	j.report.Done = true
+	report := j.snapshot()
+	j.lock.Unlock()
+	log.Infof("prewarm '%s': %s", report.ID, report.String())
+}
+
+// check checks the queued builds, a build is finished when it's removed from the queue.
+// The failure of the build is recorded before the task is removed.
+func (j *prewarmJob) check() {
+	j.lock.Lock()
+	ids := make([]string, 0, len(j.pending))
+	for id := range j.pending {
+		ids = append(ids, id)
+	}
+	j.lock.Unlock()
+
+	for _, id := range ids {
+		if buildQueue.Has(id) {
+			continue
+		}
+		j.lock.Lock()
+		item := j.pending[id]
+		delete(j.pending, id)
+		j.report.Pending--
+		j.lock.Unlock()
+
+		if _, ok := queryESMBuild(id); ok {
+			j.lock.Lock()
+			j.report.Built++
+			j.lock.Unlock()
+		} else if f, err := loadBuildFailure(id); err == nil && f != nil {
+			j.fail(item, f.Err())
+		} else {
+			j.fail(item, errors.New("the build is dropped"))
+		}
+	}
+}
+
+func (j *prewarmJob) fail(item prewarmItem, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.report.Failed++
+	j.report.Failures = append(j.report.Failures, PrewarmFailure{item, err.Error()})
+}
+
+// Report returns a copy of the job progress.
+func (j *prewarmJob) Report() PrewarmReport {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.snapshot()
+}
+
+// snapshot copies the report, it must be called with the job lock held.
+func (j *prewarmJob) snapshot() PrewarmReport {
+	r := j.report
+	r.Duration = time.Since(r.StartedAt).Round(time.Second).String()
+	r.Failures = append([]PrewarmFailure{}, j.report.Failures...)
+	return r
+}
+
+// prewarmHandler handles the prewarm requests:
+//   - `POST /_prewarm` starts a prewarm job with the json input
+//   - `GET /_prewarm?id={jobId}` returns the progress of the job, or the recent jobs without `id`
+func prewarmHandler(ctx *rex.Context) interface{} {
+	if ctx.R.Method == "GET" {
+		id := ctx.Form.Value("id")
+		if id == "" {
+			prewarmLock.Lock()
+			jobs := make([]*prewarmJob, len(prewarmJobs))
+			copy(jobs, prewarmJobs)
+			prewarmLock.Unlock()
+			reports := make([]PrewarmReport, len(jobs))
+			for i, j := range jobs {
+				reports[i] = j.Report()
+			}
+			return reports
+		}
+		j := getPrewarmJob(id)
+		if j == nil {
+			return rex.Err(404, "prewarm job not found")
+		}
+		return j.Report()
+	}
+
+	var input PrewarmInput
+	err := json.NewDecoder(io.LimitReader(ctx.R.Body, 1024*1024)).Decode(&input)
+	ctx.R.Body.Close()
+	if err != nil {
+		return rex.Err(400, "require valid json body")
+	}
+	for _, target := range input.Targets {
+		if targets[strings.ToLower(target)] == 0 {
+			return rex.Err(400, fmt.Sprintf("invalid target '%s'", target))
+		}
+	}
+	items := prewarmItems(input)
+	if input.Replay > 0 {
+		if cfg.LogDir == "" {
+			return rex.Err(400, "the access log is disabled")
+		}
+		replay, err := replayAccessLogs(cfg.LogDir, input.Replay)
+		if err != nil {
+			return rex.Err(500, err.Error())
+		}
+		items = append(items, replay...)
+	}
+	if len(items) == 0 {
+		return rex.Err(400, "no packages to prewarm")
+	}
+	cdnOrigin := input.CdnOrigin
+	if cdnOrigin == "" {
+		cdnOrigin = getCdnOrign(ctx)
+	}
+	return rex.Status(202, startPrewarm(items, strings.TrimRight(cdnOrigin, "/")).Report())
+}
+
+// adminClient requests the admin endpoints of the running server, it's used by the `prewarm` and `fsck` commands.
+type adminClient struct {
+	server string
+	secret string
+}
+
+func (c *adminClient) start(input PrewarmInput) (report PrewarmReport, err error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = c.do("POST", "/_prewarm", bytes.NewReader(data), &report)
+	return
+}
+
+func (c *adminClient) status(id string) (report PrewarmReport, err error) {
+	err = c.do("GET", "/_prewarm?id="+url.QueryEscape(id), nil, &report)
+	return
+}
+
+func (c *adminClient) do(method string, pathname string, body io.Reader, ret interface{}) error {
+	req, err := http.NewRequest(method, c.server+pathname, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.secret)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusAccepted {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("<%d> %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(res.Body).Decode(ret)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestPrewarmItems(t *testing.T) {
+	items := prewarmItems(PrewarmInput{
+		Packages: []string{"react@18", " /preact ", ""},
+		Targets:  []string{"es2022", "Deno"},
+		Dev:      true,
+	})
+	if len(items) != 8 {
+		t.Fatalf("expected 8 items, but got %d", len(items))
+	}
+	expected := []prewarmItem{
+		{Spec: "react@18", Target: "es2022"},
+		{Spec: "react@18", Target: "es2022", Dev: true},
+		{Spec: "react@18", Target: "deno"},
+		{Spec: "react@18", Target: "deno", Dev: true},
+		{Spec: "preact", Target: "es2022"},
+	}
+	for i, item := range expected {
+		if items[i] != item {
+			t.Fatalf("expected item %d to be %v, but got %v", i, item, items[i])
+		}
+	}
+
+	items = prewarmItems(PrewarmInput{Packages: []string{"vue"}, Bundle: true})
+	if len(items) != 2 || items[0].Target != "es2022" || items[0].Bundle || !items[1].Bundle {
+		t.Fatalf("unexpected items: %v", items)
+	}
+}
+
+func TestReplayAccessLog(t *testing.T) {
+	cfg = &config.Config{}
+
+	logs := []string{
+		`2024/01/02 10:00:00 1.1.1.1 esm.sh HTTP/1.1 GET /react@18.2.0 0 - "Deno/1.40.0" 200 120 3ms`,
+		`2024/01/02 10:00:01 1.1.1.2 esm.sh HTTP/2.0 GET /react@18.2.0?target=deno 0 - "curl/8.0" 200 120 2ms`,
+		`2024/01/02 10:00:02 1.1.1.3 esm.sh HTTP/2.0 GET /react@18.2.0?target=es2022&dev 0 https://example.com "Mozilla/5.0 \"quoted\"" 200 120 2ms`,
+		`2024/01/02 10:00:03 1.1.1.3 esm.sh HTTP/2.0 GET /preact@10?target=es2022&bundle 0 - "-" 200 120 2ms`,
+		`2024/01/02 10:00:04 1.1.1.3 esm.sh HTTP/2.0 GET /preact@10?target=es2022&bundle 0 - "-" 200 120 2ms`,
+		`2024/01/02 10:00:05 1.1.1.3 esm.sh HTTP/2.0 GET /preact@10?target=es2022&bundle 0 - "-" 200 120 2ms`,
+		// not a bare module request
+		`2024/01/02 10:00:06 1.1.1.3 esm.sh HTTP/2.0 GET /v135/react@18.2.0/es2022/react.mjs 0 - "-" 200 120 2ms`,
+		`2024/01/02 10:00:07 1.1.1.3 esm.sh HTTP/2.0 GET /react@18.2.0/index.d.ts 0 - "-" 200 120 2ms`,
+		`2024/01/02 10:00:08 1.1.1.3 esm.sh HTTP/2.0 GET /status.json 0 - "-" 200 120 2ms`,
+		`2024/01/02 10:00:09 1.1.1.3 esm.sh HTTP/2.0 POST /_prewarm 0 - "-" 200 120 2ms`,
+		`2024/01/02 10:00:10 1.1.1.3 esm.sh HTTP/2.0 GET /react@18.2.0?pin=v120 0 - "-" 200 120 2ms`,
+		// failed
+		`2024/01/02 10:00:11 1.1.1.3 esm.sh HTTP/2.0 GET /vue@3?target=es2022 0 - "-" 500 120 2ms`,
+		// invalid line
+		`invalid line`,
+	}
+	counts := map[prewarmItem]int{}
+	err := readAccessLog(strings.NewReader(strings.Join(logs, "\n")), counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := topPrewarmItems(counts, 2)
+	expected := []prewarmItem{
+		{Spec: "preact@10", Target: "es2022", Bundle: true},
+		{Spec: "react@18.2.0", Target: "deno"},
+	}
+	if len(items) != len(expected) {
+		t.Fatalf("expected %d items, but got %v", len(expected), items)
+	}
+	for i, item := range expected {
+		if items[i] != item {
+			t.Fatalf("expected item %d to be %v, but got %v", i, item, items[i])
+		}
+	}
+	if len(counts) != 4 {
+		t.Fatalf("expected 4 different requests, but got %v", counts)
+	}
+	if n := counts[prewarmItem{Spec: "react@18.2.0", Target: "es2022", Dev: true}]; n != 1 {
+		t.Fatalf("expected the dev request to be counted once, but got %d", n)
+	}
+}
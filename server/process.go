@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// the grace period for the subprocesses to exit after the termination signal
+const processKillGracePeriod = 3 * time.Second
+
+// runCommand runs the command in a new process group. When the context is done, the process
+// group is terminated and then killed after the grace period, so the subprocesses (e.g. the
+// `node` processes spawned by `pnpm`) will not be left behind.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	terminateProcessGroup(cmd)
+	select {
+	case <-done:
+	case <-time.After(processKillGracePeriod):
+		killProcessGroup(cmd)
+		<-done
+	}
+	return ctx.Err()
+}
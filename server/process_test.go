@@ -0,0 +1,98 @@
+//go:build !windows
+
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+func TestRunCommandCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	// the subprocess `sleep` should be killed with the shell
+	cmd := exec.Command("sh", "-c", "sleep 30 & sleep 30")
+	err := runCommand(ctx, cmd)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("the command is not killed in time: %v", d)
+	}
+}
+
+func TestClientGoneCancelsBuild(t *testing.T) {
+	// a fake `pnpm` that waits until it's killed
+	bin := t.TempDir()
+	pidFile := path.Join(bin, "pnpm.pid")
+	err := os.WriteFile(path.Join(bin, "pnpm"), []byte("#!/bin/sh\necho $$ > "+pidFile+"\nexec sleep 30\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	cfg = &config.Config{}
+	buildQueue = newBuildQueue(1, config.BuildLimits{}, config.BuildCancel{FinishThreshold: 0.8}, nil)
+	defer func() { buildQueue = nil }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &BuildQueueConsumer{C: make(chan BuildOutput, 1), client: "a"}
+	task := &queueTask{
+		BuildTask: &BuildTask{Pkg: Pkg{Name: "foo", Version: "1.0.0"}, id: "foo", stage: "install", ctx: ctx},
+		inProcess: true,
+		consumers: []*BuildQueueConsumer{c},
+		cancel:    cancel,
+	}
+	task.el = buildQueue.list.PushBack(task)
+	buildQueue.tasks[task.ID()] = task
+
+	done := make(chan error, 1)
+	go func() {
+		done <- pnpmInstall(task.context(), t.TempDir())
+	}()
+	var pid int
+	for i := 0; i < 100 && pid == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		data, _ := os.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if pid == 0 {
+		t.Fatal("the pnpm process is not started")
+	}
+
+	// the client has gone
+	reqCtx, disconnect := context.WithCancel(context.Background())
+	disconnect()
+	r := httptest.NewRequest("GET", "/foo@1.0.0", nil).WithContext(reqCtx)
+	if _, ok := waitBuild(&rex.Context{W: httptest.NewRecorder(), R: r}, task.BuildTask, c); ok {
+		t.Fatal("expected no output of the gone client")
+	}
+	if task.context().Err() == nil {
+		t.Fatal("the build should be cancelled")
+	}
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pnpm process is not killed in time")
+	}
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Fatalf("the pnpm process %d is still alive: %v", pid, err)
+	}
+}
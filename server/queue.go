@@ -2,11 +2,47 @@ package server
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+var errTooManyBuilds = errors.New("too many builds")
+
+// the time for a cancelled or timed out build to stop, a warning is logged if it's exceeded
+const buildStopGracePeriod = 10 * time.Second
+
+// BuildPriority is the priority class of a build task.
+type BuildPriority int
+
+const (
+	// PriorityPrewarm is for the builds that warm up the storage ahead of requests.
+	PriorityPrewarm BuildPriority = iota
+	// PriorityBackground is for the builds that no one is waiting for, e.g. the rebuilds of outdated builds.
+	PriorityBackground
+	// PriorityInteractive is for the builds that clients are waiting for.
+	PriorityInteractive
 )
 
+func (p BuildPriority) String() string {
+	switch p {
+	case PriorityPrewarm:
+		return "prewarm"
+	case PriorityBackground:
+		return "background"
+	case PriorityInteractive:
+		return "interactive"
+	default:
+		return "unknown"
+	}
+}
+
 // A Queue for esm build tasks
 type BuildQueue struct {
 	lock         sync.RWMutex
@@ -14,11 +50,38 @@ type BuildQueue struct {
 	tasks        map[string]*queueTask
 	processes    []*queueTask
 	maxProcesses int
+	// the number of processes reserved for the background and prewarm tasks
+	// when there are pending background tasks.
+	reserved     int
+	limits       config.BuildLimits
+	cancelPolicy config.BuildCancel
+	// the db to persist the queued tasks, optional
+	store       storage.DataBase
+	storeWriter *queueStoreWriter
+	// the tasks leased by the remote workers
+	leases  map[string]*workerLease
+	workers map[string]time.Time
+	// closed when there are new pending tasks for the remote workers
+	pending chan struct{}
+	// only the raw installs are run in the server process, the builds are run by the remote workers
+	remoteOnly bool
+	// the subscribers of the queue events
+	eventsLock  sync.RWMutex
+	subscribers map[chan BuildEvent]struct{}
+	// the finish time of the recent builds to estimate the throughput
+	finished []time.Time
+}
+
+// BuildClient is the client that requests a build, the zero value is for the background builds.
+type BuildClient struct {
+	IP    string
+	Token string
 }
 
 type BuildQueueConsumer struct {
-	IP string           `json:"ip"`
-	C  chan BuildOutput `json:"-"`
+	IP     string           `json:"ip"`
+	C      chan BuildOutput `json:"-"`
+	client string
 }
 
 type BuildOutput struct {
@@ -33,38 +96,187 @@ type queueTask struct {
 	createdAt time.Time
 	startedAt time.Time
 	consumers []*BuildQueueConsumer
+	// the priority of the task when no one is waiting for it
+	basePriority BuildPriority
+	// the client that the task is in process for
+	owner string
+	// the remote worker that the task is leased to
+	worker string
+	// the task is requested without consumer, it will not be cancelled
+	keep   bool
+	cancel context.CancelFunc
+	// the last time the status of the task is polled by the async clients
+	polledAt time.Time
+}
+
+// the estimated progress of the build stages
+var buildStageProgress = map[string]float64{
+	"pending":       0,
+	"install":       0.1,
+	"build":         0.3,
+	"transform-dts": 0.9,
+}
+
+// progress returns the estimated progress of the task.
+func (t *queueTask) progress() float64 {
+	return buildStageProgress[t.getStage()]
+}
+
+// priority returns the priority of the task, the tasks that clients are waiting for are interactive.
+func (t *queueTask) priority() BuildPriority {
+	if len(t.consumers) > 0 {
+		return PriorityInteractive
+	}
+	return t.basePriority
+}
+
+// status returns the status of the task, it must be called with the queue lock held.
+func (t *queueTask) status() map[string]interface{} {
+	m := map[string]interface{}{
+		"bundle":    t.BundleDeps,
+		"bv":        t.BuildVersion,
+		"consumers": t.consumers,
+		"createdAt": t.createdAt.Format(http.TimeFormat),
+		"dev":       t.Dev,
+		"inProcess": t.inProcess,
+		"pkg":       t.Pkg.String(),
+		"priority":  t.priority().String(),
+		"stage":     t.getStage(),
+		"target":    t.Target,
+	}
+	if !t.startedAt.IsZero() {
+		m["startedAt"] = t.startedAt.Format(http.TimeFormat)
+	}
+	if t.worker != "" {
+		m["worker"] = t.worker
+	}
+	if len(t.Args.deps) > 0 {
+		m["deps"] = t.Args.deps.String()
+	}
+	return m
 }
 
 func (t *queueTask) run() BuildOutput {
+	// the build is stopped (and the subprocesses are killed) when the timeout is exceeded
+	timeout := time.Duration(getBuildTimeouts(t.Pkg.Name).Build)
+	leaseTimeout := timeout
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(t.context(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(t.context())
+		// no limit of the build, but don't wait for the build of another instance forever
+		leaseTimeout = maxLeaseWait
+	}
+	defer cancel()
+
+	buildLog := newBuildLog()
+	t.ctx = withBuildLog(ctx, buildLog)
+
+	// the build span covers the time waiting in the queue
+	parent, _ := parseTraceparent(t.traceparent)
+	ctx, span := startRootSpan(t.context(), parent, "build", spanKindInternal, "build.id", t.ID(), "pkg", t.Pkg.String(), "target", t.Target)
+	if span != nil {
+		t.ctx = ctx
+		if !t.createdAt.IsZero() {
+			span.start = t.createdAt
+			_, wait := startSpan(ctx, "queue.wait")
+			wait.start = t.createdAt
+			wait.End(nil)
+		}
+		if t.worker != "" {
+			span.SetAttr("worker", t.worker)
+		}
+	}
+
 	c := make(chan BuildOutput, 1)
 	go func(c chan BuildOutput) {
+		lease, err := acquireLease(ctx, "build:"+t.ID(), leaseTimeout)
+		if err == nil {
+			defer lease.Unlock()
+		}
+
+		// the task may be built by another instance while waiting for the lease
+		if esm, ok := queryESMBuild(t.ID()); ok {
+			span.SetAttr("build.cached", true)
+			span.End(nil)
+			c <- BuildOutput{esm, nil}
+			return
+		}
+		if err != nil {
+			if ctx.Err() == context.Canceled {
+				err = context.Canceled
+			} else if ctx.Err() == context.DeadlineExceeded {
+				err = asTransientError(fmt.Errorf("build '%s': timeout(%v)", t.ID(), timeout))
+			}
+			span.End(err)
+			c <- BuildOutput{nil, err}
+			return
+		}
+
+		buildLog.Printf("info", "build %s (target: %s, dev: %v, bundle: %v, bundless: %v)", t.Pkg.String(), t.Target, t.Dev, t.BundleDeps, t.NoBundle)
 		meta, err := t.Build()
+		t.endStage()
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = asTransientError(fmt.Errorf("build '%s': timeout(%v)", t.ID(), timeout))
+		}
+		if err != nil {
+			buildLog.Printf("error", "%v", err)
+		} else {
+			buildLog.Printf("info", "done in %v", time.Since(t.startedAt))
+		}
+		saveBuildLog(t.ID(), buildLog)
+		span.End(err)
 		c <- BuildOutput{meta, err}
 	}(c)
 
+	// the stopped build is waited to return, so the lease and the process of the task are kept
+	// and a retry will not overlap the old build that may be still writing to the storage
 	var output BuildOutput
 	select {
 	case output = <-c:
-		if output.err == nil {
-			log.Infof("build '%s' done in %v", t.ID(), time.Since(t.startedAt))
-		} else {
-			log.Errorf("build '%s': %v", t.ID(), output.err)
-		}
-	case <-time.After(10 * time.Minute):
-		log.Errorf("build '%s': timeout(%v)", t.ID(), time.Since(t.startedAt))
-		output = BuildOutput{
-			err: fmt.Errorf("build '%s': timeout(%v)", t.ID(), time.Since(t.startedAt)),
+	case <-ctx.Done():
+		select {
+		case output = <-c:
+		case <-time.After(buildStopGracePeriod):
+			// e.g. an esbuild call can't be interrupted
+			log.Warnf("build '%s' is not stopped in %v, waiting", t.ID(), buildStopGracePeriod)
+			output = <-c
 		}
 	}
-
+	if output.err == nil {
+		log.Infof("build '%s' done in %v", t.ID(), time.Since(t.startedAt))
+	} else if output.err == context.Canceled {
+		log.Infof("build '%s' cancelled after %v", t.ID(), time.Since(t.startedAt))
+	} else {
+		log.Errorf("build '%s': %v", t.ID(), output.err)
+	}
 	return output
 }
 
-func newBuildQueue(maxProcesses int) *BuildQueue {
+func newBuildQueue(maxProcesses int, limits config.BuildLimits, cancelPolicy config.BuildCancel, store storage.DataBase) *BuildQueue {
 	q := &BuildQueue{
 		list:         list.New(),
 		tasks:        map[string]*queueTask{},
 		maxProcesses: maxProcesses,
+		limits:       limits,
+		cancelPolicy: cancelPolicy,
+		store:        store,
+		leases:       map[string]*workerLease{},
+		workers:      map[string]time.Time{},
+		pending:      make(chan struct{}),
+		subscribers:  map[chan BuildEvent]struct{}{},
+	}
+	if store != nil {
+		q.storeWriter = newQueueStoreWriter(store)
+	}
+	// reserve a quarter of the processes (at least one) for the background tasks
+	if maxProcesses > 1 {
+		q.reserved = maxProcesses / 4
+		if q.reserved == 0 {
+			q.reserved = 1
+		}
 	}
 	return q
 }
@@ -77,87 +289,344 @@ func (q *BuildQueue) Len() int {
 	return q.list.Len()
 }
 
-// Add adds a new build task.
-func (q *BuildQueue) Add(task *BuildTask, consumerIp string) *BuildQueueConsumer {
-	c := &BuildQueueConsumer{consumerIp, make(chan BuildOutput, 1)}
-	q.lock.Lock()
-	t, ok := q.tasks[task.ID()]
-	if ok && consumerIp != "" {
-		t.consumers = append(t.consumers, c)
-	}
-	q.lock.Unlock()
+// Has checks if the task is in the queue.
+func (q *BuildQueue) Has(id string) bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
 
-	if ok {
-		return c
+	_, ok := q.tasks[id]
+	return ok
+}
+
+// TaskStatus returns the status of the task in the queue.
+func (q *BuildQueue) TaskStatus(id string) (map[string]interface{}, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	t, ok := q.tasks[id]
+	if !ok {
+		return nil, false
 	}
+	return t.status(), true
+}
+
+// PollTask returns the status of the task like `TaskStatus`, it keeps the async consumers of the
+// task attached, see `ExpireConsumer`.
+func (q *BuildQueue) PollTask(id string) (map[string]interface{}, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
 
-	task.stage = "pending"
-	t = &queueTask{
-		BuildTask: task,
-		createdAt: time.Now(),
-		consumers: []*BuildQueueConsumer{},
+	t, ok := q.tasks[id]
+	if !ok {
+		return nil, false
 	}
-	if consumerIp != "" {
-		t.consumers = []*BuildQueueConsumer{c}
+	t.polledAt = time.Now()
+	return t.status(), true
+}
+
+// ExpireConsumer removes the async consumer that doesn't wait for the output of the task, if the
+// status of the task is not polled within the ttl, so the task can be cancelled or demoted like
+// the task of a gone client. It returns when the task is done or the consumer is removed.
+func (q *BuildQueue) ExpireConsumer(task *BuildTask, c *BuildQueueConsumer, ttl time.Duration) {
+	start := time.Now()
+	ticker := time.NewTicker(ttl / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.C:
+			return
+		case <-ticker.C:
+			q.lock.RLock()
+			t, ok := q.tasks[task.ID()]
+			polledAt := start
+			if ok && t.polledAt.After(polledAt) {
+				polledAt = t.polledAt
+			}
+			q.lock.RUnlock()
+			if !ok {
+				return
+			}
+			if time.Since(polledAt) > ttl {
+				q.RemoveConsumer(task, c)
+				return
+			}
+		}
 	}
+}
+
+// Add adds a new build task, the task is interactive if the client is provided,
+// otherwise it's a background task. It returns `errTooManyBuilds` if the client
+// has too many builds in the queue, or `errQueueFull` if the queue is overloaded.
+func (q *BuildQueue) Add(task *BuildTask, client BuildClient) (*BuildQueueConsumer, error) {
+	return q.AddWithPriority(task, client, PriorityBackground)
+}
+
+// AddWithPriority adds a new build task with the priority that is used when no consumer
+// is waiting for the task.
+func (q *BuildQueue) AddWithPriority(task *BuildTask, client BuildClient, priority BuildPriority) (*BuildQueueConsumer, error) {
+	c := &BuildQueueConsumer{IP: client.IP, C: make(chan BuildOutput, 1), client: q.clientKey(client)}
+
 	q.lock.Lock()
-	t.el = q.list.PushBack(t)
-	q.tasks[task.ID()] = t
+	t, ok := q.tasks[task.ID()]
+	if ok {
+		if c.client != "" {
+			t.consumers = append(t.consumers, c)
+		} else {
+			t.keep = true
+		}
+		if priority > t.basePriority {
+			t.basePriority = priority
+		}
+		if task.Prefetch > t.Prefetch {
+			t.Prefetch = task.Prefetch
+			q.persist(t)
+		}
+	} else {
+		// joining an existing task is always allowed since it doesn't add any work
+		if c.client != "" && q.limits.MaxQueuedPerClient > 0 && q.queued(c.client) >= q.limits.MaxQueuedPerClient {
+			q.lock.Unlock()
+			return nil, errTooManyBuilds
+		}
+		if c.client != "" && q.overloaded() {
+			q.lock.Unlock()
+			return nil, errQueueFull
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		task.stage = "pending"
+		task.ctx = ctx
+		t = &queueTask{
+			BuildTask:    task,
+			createdAt:    time.Now(),
+			consumers:    []*BuildQueueConsumer{},
+			basePriority: priority,
+			keep:         c.client == "",
+			cancel:       cancel,
+		}
+		if c.client != "" {
+			t.consumers = []*BuildQueueConsumer{c}
+		}
+		task.onStage = func(stage string) {
+			q.emit(t, BuildEvent{Type: buildEventStage, Stage: stage})
+		}
+		t.el = q.list.PushBack(t)
+		q.tasks[task.ID()] = t
+		q.persist(t)
+		q.emit(t, BuildEvent{Type: buildEventEnqueued, Priority: t.priority().String()})
+	}
 	q.lock.Unlock()
 
+	// the existing task may be promoted
 	q.next()
+	q.notifyWorkers()
+
+	return c, nil
+}
+
+// clientKey returns the key of the client, a client is identified by the bearer token if the
+// token is listed in the tokens, otherwise by the ip.
+func (q *BuildQueue) clientKey(client BuildClient) string {
+	if client.Token != "" {
+		if _, ok := q.limits.Tokens[client.Token]; ok {
+			return client.Token
+		}
+	}
+	return client.IP
+}
+
+func (q *BuildQueue) weight(key string) int {
+	if w, ok := q.limits.Tokens[key]; ok {
+		if w > 0 {
+			return w
+		}
+		return 1
+	}
+	if w := q.limits.Weights[key]; w > 0 {
+		return w
+	}
+	return 1
+}
 
-	return c
+// queued returns the number of the tasks that the client is waiting for.
+func (q *BuildQueue) queued(key string) int {
+	n := 0
+	for _, t := range q.tasks {
+		for _, c := range t.consumers {
+			if c.client == key {
+				n++
+				break
+			}
+		}
+	}
+	return n
 }
 
+// RemoveConsumer removes the consumer from the task. The task is cancelled if no one is waiting
+// for it, unless it's a background task or it's almost done according to the cancel policy.
 func (q *BuildQueue) RemoveConsumer(task *BuildTask, c *BuildQueueConsumer) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
 	t, ok := q.tasks[task.ID()]
-	if ok {
-		consumers := make([]*BuildQueueConsumer, len(t.consumers))
-		i := 0
-		for _, _c := range t.consumers {
-			if _c != c {
-				consumers[i] = c
-				i++
-			}
+	if !ok {
+		return
+	}
+
+	consumers := make([]*BuildQueueConsumer, len(t.consumers))
+	i := 0
+	for _, _c := range t.consumers {
+		if _c != c {
+			consumers[i] = _c
+			i++
 		}
-		t.consumers = consumers[0:i]
 	}
+	t.consumers = consumers[0:i]
+
+	if len(t.consumers) > 0 || t.keep || q.cancelPolicy.Disabled {
+		return
+	}
+	if !t.inProcess {
+		q.list.Remove(t.el)
+		q.unpersist(t.ID())
+		// the pending task is never finished by the queue, the running task is finished with the
+		// cancelled error
+		q.emit(t, BuildEvent{Type: buildEventFailed, Error: context.Canceled.Error()})
+		metricBuildsTotal.Inc(buildStatus(context.Canceled))
+	} else if t.progress() >= q.cancelPolicy.FinishThreshold {
+		return
+	}
+	// the cancelled task is removed from the tasks, so a new request of the
+	// same build will start a new task
+	delete(q.tasks, t.ID())
+	t.cancel()
+	log.Infof("build '%s' is abandoned at the '%s' stage, cancelling", t.ID(), t.getStage())
 }
 
+// next starts the pending tasks if there are free processes. The interactive tasks are
+// scheduled first, but they can't take the reserved processes when there are pending
+// background tasks. The interactive tasks are shared by the clients in proportion to
+// their weights, and the other tasks are scheduled in FIFO order.
 func (q *BuildQueue) next() {
-	var nextTask *queueTask
 	q.lock.Lock()
-	if len(q.processes) < q.maxProcesses {
-		for el := q.list.Front(); el != nil; el = el.Next() {
-			t, ok := el.Value.(*queueTask)
-			if ok && !t.inProcess {
-				nextTask = t
-				break
+	defer q.lock.Unlock()
+
+	for q.localProcesses() < q.maxProcesses {
+		nextTask, owner := q.pick(false)
+		if nextTask == nil {
+			return
+		}
+		nextTask.inProcess = true
+		nextTask.owner = owner
+		nextTask.startedAt = time.Now()
+		q.persist(nextTask)
+		q.processes = append(q.processes, nextTask)
+		metricQueueWait.ObserveSince(nextTask.createdAt, nextTask.priority().String())
+		q.emit(nextTask, BuildEvent{
+			Type:     buildEventStarted,
+			Priority: nextTask.priority().String(),
+			Duration: time.Since(nextTask.createdAt).Milliseconds(),
+		})
+		go q.wait(nextTask)
+	}
+}
+
+func (q *BuildQueue) localProcesses() int {
+	n := 0
+	for _, t := range q.processes {
+		if t.worker == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// pick picks the next task to run, the reserved processes for the background tasks
+// only apply to the local processes.
+func (q *BuildQueue) pick(remote bool) (*queueTask, string) {
+	running := map[string]int{}
+	interactive := 0
+	for _, t := range q.processes {
+		if t.owner != "" {
+			running[t.owner]++
+		}
+		if t.worker == "" && t.priority() == PriorityInteractive {
+			interactive++
+		}
+	}
+
+	var pending [PriorityInteractive + 1]*queueTask
+	var owner string
+	var load float64
+	for el := q.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*queueTask)
+		if !ok || t.inProcess || !q.runnable(t, remote) {
+			continue
+		}
+		p := t.priority()
+		if p == PriorityInteractive {
+			// pick the task of the client with the least load, the tasks with the same load
+			// are scheduled in FIFO order
+			o, l, ok := q.fairShare(t, running)
+			if ok && (pending[p] == nil || l < load) {
+				pending[p] = t
+				owner = o
+				load = l
 			}
+		} else if pending[p] == nil {
+			pending[p] = t
 		}
 	}
-	q.lock.Unlock()
 
-	if nextTask == nil {
-		return
+	if t := pending[PriorityInteractive]; t != nil {
+		if remote || interactive < q.maxProcesses-q.reserved || (pending[PriorityBackground] == nil && pending[PriorityPrewarm] == nil) {
+			return t, owner
+		}
+	}
+	if t := pending[PriorityBackground]; t != nil {
+		return t, ""
 	}
+	return pending[PriorityPrewarm], ""
+}
 
-	q.lock.Lock()
-	nextTask.inProcess = true
-	q.processes = append(q.processes, nextTask)
-	q.lock.Unlock()
+func (q *BuildQueue) runnable(t *queueTask, remote bool) bool {
+	// the raw files are installed in the local work directory to be served
+	if t.Target == "raw" {
+		return !remote
+	}
+	return remote || !q.remoteOnly
+}
 
-	go q.wait(nextTask)
+// fairShare returns the consumer of the task with the least load, the load of a client is the number
+// of its tasks in process divided by its weight. It returns false if all the consumers are over the
+// process limit.
+func (q *BuildQueue) fairShare(t *queueTask, running map[string]int) (owner string, load float64, ok bool) {
+	for _, c := range t.consumers {
+		n := running[c.client]
+		if q.limits.MaxProcessesPerClient > 0 && n >= q.limits.MaxProcessesPerClient {
+			continue
+		}
+		l := float64(n) / float64(q.weight(c.client))
+		if !ok || l < load {
+			owner, load, ok = c.client, l, true
+		}
+	}
+	return
 }
 
 func (q *BuildQueue) wait(t *queueTask) {
-	t.startedAt = time.Now()
+	q.finish(t, t.run())
+}
 
-	output := t.run()
+// finish removes the task from the queue and sends the output to the consumers.
+func (q *BuildQueue) finish(t *queueTask, output BuildOutput) {
+	// record the failure before removing the task, so the failure is visible
+	// once the task is not in the queue
+	if q.store != nil {
+		if output.err != nil {
+			recordBuildFailure(t.ID(), output.err)
+		} else if _, err := clearBuildFailure(t.ID()); err != nil {
+			log.Warnf("db: %v", err)
+		}
+	}
 
 	q.lock.Lock()
 	a := make([]*queueTask, len(q.processes))
@@ -170,8 +639,31 @@ func (q *BuildQueue) wait(t *queueTask) {
 	}
 	q.processes = a[0:i]
 	q.list.Remove(t.el)
-	delete(q.tasks, t.ID())
+	// the cancelled task may be replaced by a new task with the same id
+	if current, ok := q.tasks[t.ID()]; !ok || current == t {
+		delete(q.tasks, t.ID())
+		q.unpersist(t.ID())
+	}
+	prefetch := t.Prefetch
+	if output.err == nil || !isCanceled(output.err) {
+		q.recordFinish(time.Now())
+	}
 	q.lock.Unlock()
+	t.cancel()
+
+	event := BuildEvent{Type: buildEventFinished, Worker: t.worker, Duration: time.Since(t.startedAt).Milliseconds()}
+	if output.err != nil {
+		event.Type = buildEventFailed
+		event.Error = output.err.Error()
+	}
+	q.emit(t, event)
+	status := buildStatus(output.err)
+	metricBuildsTotal.Inc(status)
+	metricBuildDuration.ObserveSince(t.startedAt, t.Target, status)
+
+	if output.err == nil && output.meta != nil && prefetch > 0 {
+		go q.prefetch(t.BuildTask, output.meta, prefetch)
+	}
 
 	// call next task
 	q.next()
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// The backpressure of the build queue. Under a burst, the new build requests are rejected with
+// `503 Service Unavailable` instead of piling up in the queue until they time out, when the pending
+// interactive builds are over the `maxQueueLength`, or the estimated waiting time of a new build
+// is over the `maxWait`. The `Retry-After` is estimated from the recent build throughput.
+//
+// The requests joining the builds in the queue and the background builds are always accepted, and
+// the builds that are done keep serving normally.
+
+var errQueueFull = errors.New("the build queue is full")
+
+// the window of the recent builds to estimate the throughput
+const throughputWindow = 5 * time.Minute
+
+// the min span of the window, to not overestimate the throughput with a few builds after startup
+const throughputMinSpan = 10 * time.Second
+
+// the bounds of the estimated `Retry-After`
+const (
+	minRetryAfter = time.Second
+	maxRetryAfter = 5 * time.Minute
+)
+
+// recordFinish records the finish time of a build, it must be called with the queue lock held.
+func (q *BuildQueue) recordFinish(now time.Time) {
+	q.finished = append(q.finished, now)
+	q.trimFinished(now)
+}
+
+func (q *BuildQueue) trimFinished(now time.Time) {
+	i := 0
+	for i < len(q.finished) && now.Sub(q.finished[i]) > throughputWindow {
+		i++
+	}
+	if i > 0 {
+		q.finished = append(q.finished[:0], q.finished[i:]...)
+	}
+}
+
+// throughput returns the number of the builds finished per second in the window, or 0 if there
+// are no recent builds. It must be called with the queue lock held.
+func (q *BuildQueue) throughput(now time.Time) float64 {
+	q.trimFinished(now)
+	if len(q.finished) == 0 {
+		return 0
+	}
+	span := now.Sub(q.finished[0])
+	if span < throughputMinSpan {
+		span = throughputMinSpan
+	}
+	return float64(len(q.finished)) / span.Seconds()
+}
+
+// pendingInteractive returns the number of the pending interactive tasks, the background and
+// prewarm tasks are not counted since the interactive tasks are scheduled first. It must be
+// called with the queue lock held.
+func (q *BuildQueue) pendingInteractive() int {
+	n := 0
+	for el := q.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*queueTask)
+		if ok && !t.inProcess && t.priority() == PriorityInteractive {
+			n++
+		}
+	}
+	return n
+}
+
+// estimateWait returns the estimated waiting time of a new interactive build, or -1 if the
+// throughput is unknown. It must be called with the queue lock held.
+func (q *BuildQueue) estimateWait(now time.Time) time.Duration {
+	pending := q.pendingInteractive()
+	if pending == 0 {
+		return 0
+	}
+	rate := q.throughput(now)
+	if rate == 0 {
+		return -1
+	}
+	return time.Duration(float64(pending+1) / rate * float64(time.Second))
+}
+
+// overloaded checks if the queue is over the `maxQueueLength` or the `maxWait`, it must be called
+// with the queue lock held.
+func (q *BuildQueue) overloaded() bool {
+	if max := q.limits.MaxQueueLength; max > 0 && q.pendingInteractive() >= max {
+		return true
+	}
+	if max := time.Duration(q.limits.MaxWait); max > 0 && q.estimateWait(time.Now()) > max {
+		return true
+	}
+	return false
+}
+
+// RetryAfter returns the estimated time for the overloaded queue to accept new builds, the
+// `retryAfter` of the limits is used if the throughput is unknown.
+func (q *BuildQueue) RetryAfter() time.Duration {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	rate := q.throughput(now)
+	if rate == 0 {
+		if d := time.Duration(q.limits.RetryAfter); d > 0 {
+			return d
+		}
+		return 30 * time.Second
+	}
+
+	var d time.Duration
+	if max := q.limits.MaxQueueLength; max > 0 {
+		if excess := q.pendingInteractive() - max + 1; excess > 0 {
+			d = time.Duration(float64(excess) / rate * float64(time.Second))
+		}
+	}
+	if max := time.Duration(q.limits.MaxWait); max > 0 {
+		if excess := q.estimateWait(now) - max; excess > d {
+			d = excess
+		}
+	}
+	if d < minRetryAfter {
+		d = minRetryAfter
+	} else if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+// queueRecord is the descriptor of a queued task, it's stored in the db with the `queue-`
+// key prefix to restore the queue after the server restarts.
+type queueRecord struct {
+	Pkg          Pkg           `json:"pkg"`
+	Args         BuildArgs     `json:"args"`
+	CdnOrigin    string        `json:"cdnOrigin,omitempty"`
+	Target       string        `json:"target"`
+	BuildVersion int           `json:"bv"`
+	Dev          bool          `json:"dev,omitempty"`
+	BundleDeps   bool          `json:"bundle,omitempty"`
+	NoBundle     bool          `json:"noBundle,omitempty"`
+	Prefetch     int           `json:"prefetch,omitempty"`
+	Priority     BuildPriority `json:"priority"`
+	CreatedAt    int64         `json:"createdAt"`
+	StartedAt    int64         `json:"startedAt,omitempty"`
+	InProcess    bool          `json:"inProcess,omitempty"`
+	Trace        string        `json:"trace,omitempty"`
+}
+
+func (r *queueRecord) task() *BuildTask {
+	return &BuildTask{
+		Args:         r.Args,
+		Pkg:          r.Pkg,
+		CdnOrigin:    r.CdnOrigin,
+		Target:       r.Target,
+		BuildVersion: r.BuildVersion,
+		Dev:          r.Dev,
+		BundleDeps:   r.BundleDeps,
+		NoBundle:     r.NoBundle,
+		Prefetch:     r.Prefetch,
+		traceparent:  r.Trace,
+	}
+}
+
+func newQueueRecord(t *queueTask) queueRecord {
+	r := queueRecord{
+		Pkg:          t.Pkg,
+		Args:         t.Args,
+		CdnOrigin:    t.CdnOrigin,
+		Target:       t.Target,
+		BuildVersion: t.BuildVersion,
+		Dev:          t.Dev,
+		BundleDeps:   t.BundleDeps,
+		NoBundle:     t.NoBundle,
+		Prefetch:     t.Prefetch,
+		Priority:     t.basePriority,
+		CreatedAt:    t.createdAt.Unix(),
+		InProcess:    t.inProcess,
+		Trace:        t.traceparent,
+	}
+	if !t.startedAt.IsZero() {
+		r.StartedAt = t.startedAt.Unix()
+	}
+	return r
+}
+
+// queueStoreWriter writes the queue records to the db in the background, so the db writes are not
+// done with the queue lock held. The writes of the same task are coalesced, only the latest one is
+// written.
+type queueStoreWriter struct {
+	store storage.DataBase
+	// the lock of the pending writes
+	lock    sync.Mutex
+	pending map[string][]byte // nil value for the deletion
+	// the lock of the db writes, to keep the order of the writes of the same task
+	writeLock sync.Mutex
+	signal    chan struct{}
+}
+
+func newQueueStoreWriter(store storage.DataBase) *queueStoreWriter {
+	w := &queueStoreWriter{
+		store:   store,
+		pending: map[string][]byte{},
+		signal:  make(chan struct{}, 1),
+	}
+	go func() {
+		for range w.signal {
+			w.Flush()
+		}
+	}()
+	return w
+}
+
+func (w *queueStoreWriter) set(key string, value []byte) {
+	w.lock.Lock()
+	w.pending[key] = value
+	w.lock.Unlock()
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Flush writes the pending records to the db.
+func (w *queueStoreWriter) Flush() {
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+
+	w.lock.Lock()
+	pending := w.pending
+	w.pending = map[string][]byte{}
+	w.lock.Unlock()
+
+	for key, value := range pending {
+		if value == nil {
+			if err := w.store.Delete(key); err != nil {
+				log.Warnf("queue: db.Delete(%s): %v", key, err)
+			}
+		} else if err := w.store.Put(key, value); err != nil {
+			log.Warnf("queue: db.Put(%s): %v", key, err)
+		}
+	}
+}
+
+// persist stores the task in the db, it must be called with the queue lock held. The record is
+// taken under the lock and written to the db in the background.
+func (q *BuildQueue) persist(t *queueTask) {
+	if q.storeWriter == nil {
+		return
+	}
+	q.storeWriter.set("queue-"+t.ID(), utils.MustEncodeJSON(newQueueRecord(t)))
+}
+
+// unpersist removes the task from the db, it must be called with the queue lock held.
+func (q *BuildQueue) unpersist(id string) {
+	if q.storeWriter == nil {
+		return
+	}
+	q.storeWriter.set("queue-"+id, nil)
+}
+
+// FlushStore writes the pending records of the queue to the db, it's called before the server
+// shutdown.
+func (q *BuildQueue) FlushStore() {
+	if q.storeWriter != nil {
+		q.storeWriter.Flush()
+	}
+}
+
+// Restore re-enqueues the tasks persisted in the db as background tasks in the order of creation,
+// since no one is waiting for them after the restart. The tasks that were in process are marked as
+// failed. With the `db` locker, the in-process tasks that are still being built by another server
+// instance are skipped; the `memory` locker can't tell it, the in-process tasks are taken as the
+// ones of a crashed run of this server.
+func (q *BuildQueue) Restore() (n int, err error) {
+	if q.store == nil {
+		return
+	}
+	keys, err := q.store.List("queue-")
+	if err != nil {
+		return
+	}
+	type record struct {
+		key string
+		queueRecord
+	}
+	records := make([]record, 0, len(keys))
+	for _, key := range keys {
+		var value []byte
+		value, err = q.store.Get(key)
+		if err != nil {
+			return
+		}
+		if value == nil {
+			continue
+		}
+		r := record{key: key}
+		if json.Unmarshal(value, &r.queueRecord) != nil {
+			log.Warnf("queue: invalid record '%s'", key)
+			q.store.Delete(key)
+			continue
+		}
+		records = append(records, r)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].CreatedAt < records[j].CreatedAt
+	})
+
+	for _, r := range records {
+		task := r.task()
+		if r.InProcess {
+			if cfg != nil && cfg.Locker == "db" {
+				var lease storage.Lease
+				lease, err = locker.TryLock("build:"+task.ID(), leaseTTL)
+				if err == storage.ErrLocked {
+					err = nil
+					continue
+				}
+				if err != nil {
+					return
+				}
+				lease.Unlock()
+			}
+			recordBuildFailure(task.ID(), asTransientError(errors.New("interrupted by the server shutdown")))
+			err = q.store.Delete(r.key)
+			if err != nil {
+				return
+			}
+			log.Warnf("queue: build '%s' was interrupted at %s, marked as failed", task.ID(), time.Unix(r.StartedAt, 0).Format(time.RFC3339))
+			continue
+		}
+		priority := r.Priority
+		if priority > PriorityBackground {
+			priority = PriorityBackground
+		}
+		q.AddWithPriority(task, BuildClient{}, priority)
+		n++
+	}
+	return
+}
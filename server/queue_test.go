@@ -0,0 +1,454 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+func TestBuildQueuePick(t *testing.T) {
+	q := newBuildQueue(4, config.BuildLimits{}, config.BuildCancel{}, nil)
+	if q.reserved != 1 {
+		t.Fatalf("expected 1 reserved process, got %d", q.reserved)
+	}
+
+	add := func(name string, priority BuildPriority, waiting bool) *queueTask {
+		task := &queueTask{BuildTask: &BuildTask{Pkg: Pkg{Name: name}}, basePriority: priority}
+		if waiting {
+			task.consumers = []*BuildQueueConsumer{{IP: "127.0.0.1", client: "127.0.0.1"}}
+		}
+		task.el = q.list.PushBack(task)
+		return task
+	}
+	start := func(expected string) {
+		task, owner := q.pick(false)
+		if task == nil {
+			t.Fatalf("expected %s, got nothing", expected)
+		}
+		if task.Pkg.Name != expected {
+			t.Fatalf("expected %s, got %s", expected, task.Pkg.Name)
+		}
+		task.inProcess = true
+		task.owner = owner
+		q.processes = append(q.processes, task)
+	}
+
+	add("prewarm", PriorityPrewarm, false)
+	add("background", PriorityBackground, false)
+	promoted := add("promoted", PriorityBackground, true)
+	add("a", PriorityBackground, true)
+	add("b", PriorityBackground, true)
+	add("c", PriorityBackground, true)
+
+	if promoted.priority() != PriorityInteractive {
+		t.Fatalf("expected interactive, got %s", promoted.priority())
+	}
+
+	// the waiting consumers are scheduled first
+	start("promoted")
+	start("a")
+	start("b")
+	// the reserved process is taken by the background task
+	start("background")
+
+	// the prewarm task takes the reserved process after the background tasks
+	q.processes = q.processes[:3]
+	start("prewarm")
+	// the interactive task can take the reserved process if no background task is pending
+	q.processes = q.processes[:3]
+	start("c")
+	if task, _ := q.pick(false); task != nil {
+		t.Fatalf("expected nothing, got %s", task.Pkg.Name)
+	}
+}
+
+func TestBuildQueueFairShare(t *testing.T) {
+	q := newBuildQueue(8, config.BuildLimits{
+		MaxProcessesPerClient: 3,
+		Tokens:                map[string]int{"token": 2},
+	}, config.BuildCancel{}, nil)
+
+	add := func(name string, clients ...string) {
+		task := &queueTask{BuildTask: &BuildTask{Pkg: Pkg{Name: name}}, basePriority: PriorityBackground}
+		for _, client := range clients {
+			task.consumers = append(task.consumers, &BuildQueueConsumer{client: client})
+		}
+		task.el = q.list.PushBack(task)
+		q.tasks[name] = task
+	}
+	start := func(expected string, expectedOwner string) {
+		task, owner := q.pick(false)
+		if task == nil {
+			t.Fatalf("expected %s, got nothing", expected)
+		}
+		if task.Pkg.Name != expected || owner != expectedOwner {
+			t.Fatalf("expected %s(%s), got %s(%s)", expected, expectedOwner, task.Pkg.Name, owner)
+		}
+		task.inProcess = true
+		task.owner = owner
+		q.processes = append(q.processes, task)
+	}
+
+	add("a1", "a")
+	add("a2", "a")
+	add("a3", "a")
+	add("a4", "a")
+	add("t1", "token")
+	add("t2", "token")
+	add("t3", "token")
+	add("b1", "b", "a")
+
+	start("a1", "a")
+	start("t1", "token")
+	start("b1", "b")
+	// the token client has double weight
+	start("t2", "token")
+	start("a2", "a")
+	start("t3", "token")
+	start("a3", "a")
+	// the clients are over the process limit
+	if task, _ := q.pick(false); task != nil {
+		t.Fatalf("expected nothing, got %s", task.Pkg.Name)
+	}
+
+	if n := q.queued("a"); n != 5 {
+		t.Fatalf("expected 5 queued tasks of a, got %d", n)
+	}
+}
+
+func TestBuildQueueCancel(t *testing.T) {
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{FinishThreshold: 0.8}, nil)
+
+	add := func(name string, stage string, inProcess bool, consumers ...string) (*queueTask, []*BuildQueueConsumer) {
+		ctx, cancel := context.WithCancel(context.Background())
+		task := &queueTask{
+			BuildTask: &BuildTask{Pkg: Pkg{Name: name}, id: name, stage: stage, ctx: ctx},
+			inProcess: inProcess,
+			keep:      len(consumers) == 0,
+			cancel:    cancel,
+		}
+		for _, client := range consumers {
+			task.consumers = append(task.consumers, &BuildQueueConsumer{client: client})
+		}
+		task.el = q.list.PushBack(task)
+		q.tasks[name] = task
+		return task, task.consumers
+	}
+
+	pending, pc := add("pending", "pending", false, "a")
+	running, rc := add("running", "build", true, "a", "b")
+	almostDone, ac := add("almost-done", "transform-dts", true, "a")
+	background, _ := add("background", "build", true)
+
+	q.RemoveConsumer(pending.BuildTask, pc[0])
+	if _, ok := q.tasks["pending"]; ok || pending.ctx.Err() == nil || q.list.Len() != 3 {
+		t.Fatal("the pending task should be removed")
+	}
+
+	q.RemoveConsumer(running.BuildTask, rc[0])
+	if running.ctx.Err() != nil {
+		t.Fatal("the running task should not be cancelled while b is waiting")
+	}
+	q.RemoveConsumer(running.BuildTask, rc[1])
+	if _, ok := q.tasks["running"]; ok || running.ctx.Err() == nil {
+		t.Fatal("the running task should be cancelled")
+	}
+
+	q.RemoveConsumer(almostDone.BuildTask, ac[0])
+	if almostDone.ctx.Err() != nil {
+		t.Fatal("the almost done task should not be cancelled")
+	}
+	if background.ctx.Err() != nil {
+		t.Fatal("the background task should not be cancelled")
+	}
+}
+
+func TestBuildQueueRestore(t *testing.T) {
+	setupTestStorage(t)
+	// the interrupted builds are told by the db locker
+	cfg.Locker = "db"
+	defaultLocker := locker
+	locker = storage.NewDBLocker(db)
+	defer func() { locker = defaultLocker }()
+
+	newTask := func(name string) *BuildTask {
+		return &BuildTask{
+			Args: BuildArgs{
+				alias:      map[string]string{},
+				deps:       PkgSlice{Pkg{Name: "react", Version: "18.2.0"}},
+				external:   newStringSet(),
+				exports:    newStringSet(),
+				conditions: newStringSet(),
+			},
+			Pkg:          Pkg{Name: name, Version: "1.0.0"},
+			Target:       "es2022",
+			BuildVersion: VERSION,
+		}
+	}
+
+	// no process to keep the tasks pending
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, db)
+	pending := newTask("pending")
+	if _, err := q.Add(pending, BuildClient{IP: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	interrupted := newTask("interrupted")
+	if _, err := q.AddWithPriority(interrupted, BuildClient{}, PriorityPrewarm); err != nil {
+		t.Fatal(err)
+	}
+	q.lock.Lock()
+	task := q.tasks[interrupted.ID()]
+	task.inProcess = true
+	task.startedAt = time.Now()
+	q.persist(task)
+	q.lock.Unlock()
+	q.FlushStore()
+
+	q = newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, db)
+	n, err := q.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || q.Len() != 1 {
+		t.Fatalf("expected 1 restored task, got %d", n)
+	}
+	task, ok := q.tasks[pending.ID()]
+	if !ok {
+		t.Fatal("the pending task is not restored")
+	}
+	if task.priority() != PriorityBackground || task.Args.deps.String() != "react@18.2.0" {
+		t.Fatalf("invalid restored task: %s %s", task.priority(), task.Args.deps.String())
+	}
+
+	if value, _ := db.Get("queue-" + interrupted.ID()); value != nil {
+		t.Fatal("the record of the interrupted task should be removed")
+	}
+	if _, ok := getBuildFailure(interrupted.ID()); !ok {
+		t.Fatal("the interrupted task should be marked as failed")
+	}
+
+	// the failed task is not restored again
+	q = newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, db)
+	if n, _ := q.Restore(); n != 1 {
+		t.Fatalf("expected 1 restored task, got %d", n)
+	}
+
+	// with the memory locker, the in-process task is of a crashed run of this server
+	cfg.Locker = "memory"
+	locker = storage.NewMemoryLocker()
+	running := newTask("running")
+	q.AddWithPriority(running, BuildClient{}, PriorityPrewarm)
+	q.lock.Lock()
+	task = q.tasks[running.ID()]
+	task.inProcess = true
+	q.persist(task)
+	q.lock.Unlock()
+	q.FlushStore()
+	q = newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, db)
+	q.Restore()
+	if _, ok := q.tasks[running.ID()]; ok {
+		t.Fatal("the in-process task should not be restored")
+	}
+	if value, _ := db.Get("queue-" + running.ID()); value != nil {
+		t.Fatal("the record of the in-process task should be removed")
+	}
+	if _, ok := getBuildFailure(running.ID()); !ok {
+		t.Fatal("the in-process task should be marked as failed")
+	}
+}
+
+func TestBuildQueueRestoreOrder(t *testing.T) {
+	setupTestStorage(t)
+	cfg.Locker = "memory"
+
+	// the records are stored in the key order, "a" < "b" < "c"
+	now := time.Now()
+	for i, name := range []string{"c", "a", "b"} {
+		task := &queueTask{
+			BuildTask: &BuildTask{
+				Args:         BuildArgs{alias: map[string]string{}, deps: PkgSlice{}, external: newStringSet(), exports: newStringSet(), conditions: newStringSet()},
+				Pkg:          Pkg{Name: name, Version: "1.0.0"},
+				Target:       "es2022",
+				BuildVersion: VERSION,
+			},
+			createdAt:    now.Add(time.Duration(i) * time.Second),
+			basePriority: PriorityBackground,
+		}
+		db.Put("queue-"+task.ID(), utils.MustEncodeJSON(newQueueRecord(task)))
+	}
+
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, db)
+	if n, err := q.Restore(); err != nil || n != 3 {
+		t.Fatalf("expected 3 restored tasks, got %d, %v", n, err)
+	}
+	names := []string{}
+	for el := q.list.Front(); el != nil; el = el.Next() {
+		names = append(names, el.Value.(*queueTask).Pkg.Name)
+	}
+	if strings.Join(names, ",") != "c,a,b" {
+		t.Fatalf("expected the tasks restored in the order of creation, got %v", names)
+	}
+}
+
+func TestBuildQueueTaskStatus(t *testing.T) {
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+
+	if _, ok := q.TaskStatus("foo"); ok {
+		t.Fatal("the task should not be found")
+	}
+	_, err := q.Add(&BuildTask{Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022", id: "foo"}, BuildClient{IP: "1.1.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, ok := q.TaskStatus("foo")
+	if !ok {
+		t.Fatal("the task should be found")
+	}
+	if status["stage"] != "pending" || status["priority"] != "interactive" || status["pkg"] != "foo@1.0.0" || status["inProcess"] != false {
+		t.Fatalf("unexpected status: %v", status)
+	}
+}
+
+func TestBuildQueueBackpressure(t *testing.T) {
+	q := newBuildQueue(0, config.BuildLimits{
+		MaxQueueLength: 2,
+		MaxWait:        config.Duration(time.Minute),
+		RetryAfter:     config.Duration(10 * time.Second),
+	}, config.BuildCancel{}, nil)
+
+	add := func(name string, client BuildClient) error {
+		_, err := q.Add(&BuildTask{Pkg: Pkg{Name: name, Version: "1.0.0"}, Target: "es2022", id: name}, client)
+		return err
+	}
+
+	if err := add("a", BuildClient{IP: "1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := add("b", BuildClient{IP: "2.2.2.2"}); err != nil {
+		t.Fatal(err)
+	}
+	// the queue is full
+	if err := add("c", BuildClient{IP: "3.3.3.3"}); err != errQueueFull {
+		t.Fatalf("expected errQueueFull, got %v", err)
+	}
+	// joining the task in the queue and the background builds are always accepted
+	if err := add("a", BuildClient{IP: "3.3.3.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := add("d", BuildClient{}); err != nil {
+		t.Fatal(err)
+	}
+	// the throughput is unknown
+	if d := q.RetryAfter(); d != 10*time.Second {
+		t.Fatalf("expected the default retry after, got %v", d)
+	}
+
+	// 30 builds in the last minute, 0.5 builds per second
+	now := time.Now()
+	q.lock.Lock()
+	for i := 0; i < 30; i++ {
+		q.recordFinish(now.Add(-time.Duration(60-i*2) * time.Second))
+	}
+	// the outdated builds are not counted
+	q.finished = append([]time.Time{now.Add(-time.Hour)}, q.finished...)
+	if rate := q.throughput(now); rate < 0.49 || rate > 0.51 {
+		t.Fatalf("expected 0.5 builds per second, got %v", rate)
+	}
+	if wait := q.estimateWait(now); wait < 5900*time.Millisecond || wait > 6100*time.Millisecond {
+		t.Fatalf("expected 6s waiting time, got %v", wait)
+	}
+	q.lock.Unlock()
+	// one build is over the max queue length, it takes 2s to drain
+	if d := q.RetryAfter(); d < 1900*time.Millisecond || d > 2100*time.Millisecond {
+		t.Fatalf("expected 2s retry after, got %v", d)
+	}
+
+	// the estimated waiting time is over the max wait
+	q = newBuildQueue(0, config.BuildLimits{MaxWait: config.Duration(3 * time.Second)}, config.BuildCancel{}, nil)
+	q.lock.Lock()
+	q.recordFinish(now.Add(-9 * time.Second))
+	q.lock.Unlock()
+	// 0.1 builds per second, the waiting time of the first build in the queue is 0
+	if err := add("a", BuildClient{IP: "1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := add("b", BuildClient{IP: "1.1.1.1"}); err != errQueueFull {
+		t.Fatalf("expected errQueueFull, got %v", err)
+	}
+	// (1+1)/0.1 - 3 = 17s
+	if d := q.RetryAfter(); d < 16*time.Second || d > 18*time.Second {
+		t.Fatalf("expected 17s retry after, got %v", d)
+	}
+}
+
+func TestBuildQueueExpireConsumer(t *testing.T) {
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+
+	task := &BuildTask{Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022", id: "foo"}
+	c, err := q.Add(task, BuildClient{IP: "1.1.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		q.ExpireConsumer(task, c, 200*time.Millisecond)
+		close(done)
+	}()
+
+	// the polling keeps the consumer attached
+	for i := 0; i < 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, ok := q.PollTask("foo"); !ok {
+			t.Fatal("the task should be found")
+		}
+	}
+	select {
+	case <-done:
+		t.Fatal("the consumer of the polled task should not be expired")
+	default:
+	}
+
+	// the abandoned task is cancelled after the ttl
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the consumer should be expired")
+	}
+	if _, ok := q.TaskStatus("foo"); ok {
+		t.Fatal("the abandoned task should be cancelled")
+	}
+}
+
+func TestBuildQueueTaskStage(t *testing.T) {
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{}, nil)
+
+	task := &BuildTask{Pkg: Pkg{Name: "foo", Version: "1.0.0"}, Target: "es2022", id: "foo"}
+	if _, err := q.Add(task, BuildClient{IP: "1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	// the stage is set by the build goroutine while the status is read by the queue,
+	// run with `-race` to check the data race
+	done := make(chan struct{})
+	go func() {
+		for _, stage := range []string{"install", "build", "transform-dts"} {
+			task.setStage(stage)
+		}
+		task.endStage()
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		q.TaskStatus("foo")
+	}
+	<-done
+	if status, _ := q.TaskStatus("foo"); status["stage"] != "transform-dts" {
+		t.Fatalf("unexpected stage %v", status["stage"])
+	}
+	if task.swapStage("build") != "transform-dts" || task.getStage() != "build" {
+		t.Fatal("unexpected stage of swapStage")
+	}
+}
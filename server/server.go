@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"embed"
 	"flag"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/esm-dev/esm.sh/server/config"
 	"github.com/esm-dev/esm.sh/server/storage"
@@ -25,6 +27,7 @@ var (
 	cache        storage.Cache
 	db           storage.DataBase
 	fs           storage.FileSystem
+	locker       storage.Locker
 	buildQueue   *BuildQueue
 	log          *logx.Logger
 	embedFS      EmbedFS
@@ -39,13 +42,17 @@ type EmbedFS interface {
 // Serve serves ESM server
 func Serve(efs EmbedFS) {
 	var (
-		cfile string
-		isDev bool
-		err   error
+		cfile       string
+		isDev       bool
+		mode        string
+		coordinator string
+		err         error
 	)
 
 	flag.StringVar(&cfile, "config", "config.json", "the config file path")
 	flag.BoolVar(&isDev, "dev", false, "to run server in development mode")
+	flag.StringVar(&mode, "mode", "server", "the run mode, 'server' or 'worker'")
+	flag.StringVar(&coordinator, "coordinator", "", "the server url that the worker pulls build tasks from")
 	flag.Parse()
 
 	if !fileExists(cfile) {
@@ -80,6 +87,44 @@ func Serve(efs EmbedFS) {
 	}
 	log.SetLevelByName(cfg.LogLevel)
 
+	// `esmd prewarm [...packages]` requests the running server to prewarm the builds,
+	// it doesn't open the storage that may be locked by the server
+	if flag.Arg(0) == "prewarm" {
+		prewarm(flag.Args()[1:])
+		return
+	}
+
+	// `esmd fsck [-repair]` requests the running server to verify the build records against the storage,
+	// or verifies the storage directly with the `-local` flag when the server is stopped
+	if flag.Arg(0) == "fsck" {
+		fsck(flag.Args()[1:])
+		return
+	}
+
+	cache, err = storage.OpenCache(cfg.Cache)
+	if err != nil {
+		log.Fatalf("init storage(cache,%s): %v", cfg.Cache, err)
+	}
+
+	fs, err = storage.OpenFS(cfg.Storage)
+	if err != nil {
+		log.Fatalf("init storage(fs,%s): %v", cfg.Storage, err)
+	}
+
+	db, err = storage.OpenDB(cfg.Database)
+	if err != nil {
+		log.Fatalf("init storage(db,%s): %v", cfg.Database, err)
+	}
+
+	switch cfg.Locker {
+	case "memory":
+		locker = storage.NewMemoryLocker()
+	case "db":
+		locker = storage.NewDBLocker(db)
+	default:
+		log.Fatalf("init locker: unknown locker '%s'", cfg.Locker)
+	}
+
 	nodeInstallDir := os.Getenv("NODE_INSTALL_DIR")
 	if nodeInstallDir == "" {
 		nodeInstallDir = path.Join(cfg.WorkDir, "nodejs")
@@ -101,22 +146,31 @@ func Serve(efs EmbedFS) {
 		log.Fatalf("init cjs-lexer: %v", err)
 	}
 
-	cache, err = storage.OpenCache(cfg.Cache)
-	if err != nil {
-		log.Fatalf("init storage(cache,%s): %v", cfg.Cache, err)
+	if cfg.Tracing.OtlpEndpoint != "" || cfg.Tracing.File != "" {
+		tracer, err = newTracer(cfg.Tracing)
+		if err != nil {
+			log.Fatalf("init tracer: %v", err)
+		}
 	}
 
-	fs, err = storage.OpenFS(cfg.Storage)
-	if err != nil {
-		log.Fatalf("init storage(fs,%s): %v", cfg.Storage, err)
+	// `esmd -mode=worker -coordinator=URL` runs the build worker
+	if mode == "worker" {
+		runWorker(coordinator)
+		return
 	}
 
-	db, err = storage.OpenDB(cfg.Database)
+	buildQueue = newBuildQueue(int(cfg.BuildConcurrency), cfg.BuildLimits, cfg.BuildCancel, db)
+	buildQueue.remoteOnly = cfg.Workers.Enabled && cfg.Workers.NoLocalBuilds
+	n, err := buildQueue.Restore()
 	if err != nil {
-		log.Fatalf("init storage(db,%s): %v", cfg.Database, err)
+		log.Errorf("restore build queue: %v", err)
+	} else if n > 0 {
+		log.Infof("%d build tasks restored", n)
 	}
 
-	buildQueue = newBuildQueue(int(cfg.BuildConcurrency))
+	if cfg.GC.Interval > 0 {
+		go startGC(time.Duration(cfg.GC.Interval))
+	}
 
 	var accessLogger *logx.Logger
 	if cfg.LogDir == "" {
@@ -134,7 +188,7 @@ func Serve(efs EmbedFS) {
 	}
 	rex.Use(
 		rex.ErrorLogger(log),
-		rex.AccessLogger(accessLogger),
+		rex.AccessLogger(&metricsAccessLogger{accessLogger}),
 		rex.Header("Server", "esm.sh"),
 		rex.Cors(rex.CORS{
 			AllowedOrigins: []string{"*"},
@@ -142,7 +196,7 @@ func Serve(efs EmbedFS) {
 				http.MethodGet,
 				http.MethodPost,
 			},
-			ExposedHeaders:   []string{"X-TypeScript-Types"},
+			ExposedHeaders:   []string{"X-TypeScript-Types", "Location", "Retry-After"},
 			AllowCredentials: false,
 		}),
 		auth(cfg.AuthSecret),
@@ -177,12 +231,157 @@ func Serve(efs EmbedFS) {
 	}
 
 	// release resources
+	buildQueue.FlushStore()
+	tracer.Close()
 	db.Close()
 	log.FlushBuffer()
 	accessLogger.FlushBuffer()
 }
 
+func runWorker(coordinator string) {
+	if coordinator == "" {
+		log.Fatal("worker: the coordinator url is required")
+	}
+	if cfg.AuthSecret == "" {
+		log.Fatal("worker: the auth secret is required")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGABRT)
+		<-c
+		// stop pulling tasks, the running builds will be finished
+		cancel()
+	}()
+	newBuildWorker(coordinator, cfg.AuthSecret).Run(ctx, int(cfg.BuildConcurrency))
+
+	// release resources
+	tracer.Close()
+	db.Close()
+	log.FlushBuffer()
+}
+
+func fsck(args []string) {
+	var (
+		server string
+		repair bool
+		local  bool
+	)
+	fset := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fset.StringVar(&server, "server", fmt.Sprintf("http://localhost:%d", cfg.Port), "the url of the running server")
+	fset.BoolVar(&repair, "repair", false, "to remove the broken records and files")
+	fset.BoolVar(&local, "local", false, "to open the storage directly instead of requesting the running server")
+	fset.Parse(args)
+
+	var (
+		report *FsckReport
+		err    error
+	)
+	if local {
+		fs, err = storage.OpenFS(cfg.Storage)
+		if err != nil {
+			fmt.Printf("fsck: init storage(fs,%s): %v\n", cfg.Storage, err)
+			os.Exit(1)
+		}
+		db, err = storage.OpenDB(cfg.Database)
+		if err != nil {
+			fmt.Printf("fsck: init storage(db,%s): %v\n", cfg.Database, err)
+			os.Exit(1)
+		}
+		report, err = runFsck(repair)
+		db.Close()
+	} else {
+		client := &adminClient{server: strings.TrimRight(server, "/"), secret: cfg.AuthSecret}
+		report, err = client.fsck(repair)
+	}
+	if err != nil {
+		fmt.Println("fsck:", err)
+		os.Exit(1)
+	}
+	for _, p := range report.Problems {
+		if p.Key != "" {
+			fmt.Printf("%s: %s (%s)\n", p.Problem, p.Key, p.Path)
+		} else {
+			fmt.Printf("%s: %s\n", p.Problem, p.Path)
+		}
+	}
+	fmt.Println(report)
+	if len(report.Problems) > report.Repaired {
+		os.Exit(1)
+	}
+}
+
+func prewarm(args []string) {
+	var (
+		server  string
+		targets string
+		file    string
+		dev     bool
+		bundle  bool
+		replay  int
+	)
+	fset := flag.NewFlagSet("prewarm", flag.ExitOnError)
+	fset.StringVar(&server, "server", fmt.Sprintf("http://localhost:%d", cfg.Port), "the url of the running server")
+	fset.StringVar(&targets, "targets", "es2022", "the build targets, separated by comma")
+	fset.StringVar(&file, "file", "", "the file of the package list, one package per line")
+	fset.BoolVar(&dev, "dev", false, "to prewarm the development builds as well")
+	fset.BoolVar(&bundle, "bundle", false, "to prewarm the bundle builds as well")
+	fset.IntVar(&replay, "replay", 0, "to replay the top N module requests of the access log")
+	fset.Parse(args)
+
+	input := PrewarmInput{
+		Packages: fset.Args(),
+		Targets:  strings.Split(targets, ","),
+		Dev:      dev,
+		Bundle:   bundle,
+		Replay:   replay,
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Println("prewarm:", err)
+			os.Exit(1)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				input.Packages = append(input.Packages, line)
+			}
+		}
+	}
+
+	client := &adminClient{server: strings.TrimRight(server, "/"), secret: cfg.AuthSecret}
+	report, err := client.start(input)
+	if err != nil {
+		fmt.Println("prewarm:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("prewarm job '%s' started, %d builds\n", report.ID, report.Total)
+	failed, pending := 0, -1
+	for !report.Done {
+		time.Sleep(prewarmCheckInterval)
+		report, err = client.status(report.ID)
+		if err != nil {
+			fmt.Println("prewarm:", err)
+			os.Exit(1)
+		}
+		for _, f := range report.Failures[failed:] {
+			fmt.Printf("failed: %s: %s\n", f.prewarmItem, f.Error)
+		}
+		failed = len(report.Failures)
+		if report.Pending != pending || report.Done {
+			pending = report.Pending
+			fmt.Println(report)
+		}
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
 func init() {
 	embedFS = &embed.FS{}
 	log = &logx.Logger{}
+	locker = storage.NewMemoryLocker()
 }
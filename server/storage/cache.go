@@ -17,6 +17,15 @@ type Cache interface {
 	Flush() error
 }
 
+// CacheStats is the statistics of a cache, the drivers can expose it with a `Stats() CacheStats` method.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Size      int64  `json:"size"`
+}
+
 type CacheDriver interface {
 	Open(addr string, args url.Values) (cache Cache, err error)
 }
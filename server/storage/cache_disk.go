@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the header of a cache file is the expiration time in unix nanoseconds (big-endian int64),
+// zero means never expired.
+const diskCacheHeaderSize = 8
+
+// diskCache is a cache that persists the entries in the local disk, every entry is stored in
+// `{root}/{hash[:2]}/{hash}` where the hash is the sha1 of the key.
+type diskCache struct {
+	root       string
+	gcInterval time.Duration
+	gcTimer    *time.Timer
+	gcLock     sync.Mutex
+	maxSize    int64
+	size       int64 // approximate total size of the entries, updated by the sweeper
+	evicting   int32
+}
+
+func (dc *diskCache) Has(key string) (bool, error) {
+	f, err := os.Open(dc.filename(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	var header [diskCacheHeaderSize]byte
+	_, err = io.ReadFull(f, header[:])
+	if err != nil || isDiskCacheExpired(header[:]) {
+		go dc.Delete(key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (dc *diskCache) Get(key string) (value []byte, err error) {
+	filename := dc.filename(key)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+
+	if len(data) < diskCacheHeaderSize {
+		// broken cache file
+		dc.Delete(key)
+		err = ErrNotFound
+		return
+	}
+
+	if isDiskCacheExpired(data) {
+		dc.Delete(key)
+		err = ErrExpired
+		return
+	}
+
+	// update the access time for the lru eviction
+	now := time.Now()
+	os.Chtimes(filename, now, now)
+	value = data[diskCacheHeaderSize:]
+	return
+}
+
+func (dc *diskCache) Set(key string, value []byte, ttl time.Duration) error {
+	filename := dc.filename(key)
+	err := ensureDir(path.Dir(filename))
+	if err != nil {
+		return err
+	}
+
+	var expiredAt int64
+	if ttl > 0 {
+		expiredAt = time.Now().Add(ttl).UnixNano()
+	}
+	data := make([]byte, diskCacheHeaderSize+len(value))
+	binary.BigEndian.PutUint64(data, uint64(expiredAt))
+	copy(data[diskCacheHeaderSize:], value)
+
+	// write to a temporary file then rename it to make the write atomic
+	tmp, err := os.CreateTemp(path.Dir(filename), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	var prevSize int64
+	if fi, err := os.Stat(filename); err == nil {
+		prevSize = fi.Size()
+	}
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	size := atomic.AddInt64(&dc.size, int64(len(data))-prevSize)
+	if dc.maxSize > 0 && size > dc.maxSize && atomic.CompareAndSwapInt32(&dc.evicting, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&dc.evicting, 0)
+			dc.sweep()
+		}()
+	}
+	return nil
+}
+
+func (dc *diskCache) Delete(key string) error {
+	filename := dc.filename(key)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err = os.Remove(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	atomic.AddInt64(&dc.size, -fi.Size())
+	return nil
+}
+
+func (dc *diskCache) Flush() error {
+	dc.gcLock.Lock()
+	defer dc.gcLock.Unlock()
+
+	entries, err := os.ReadDir(dc.root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = os.RemoveAll(path.Join(dc.root, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&dc.size, 0)
+	return nil
+}
+
+func (dc *diskCache) filename(key string) string {
+	sum := sha1.Sum([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+	return path.Join(dc.root, hash[:2], hash)
+}
+
+func (dc *diskCache) gc() {
+	dc.gcTimer = time.AfterFunc(dc.gcInterval, dc.gc)
+	dc.sweep()
+}
+
+// sweep removes the expired entries, and evicts the least recently used entries
+// if the total size exceeds the `maxSize`.
+func (dc *diskCache) sweep() {
+	dc.gcLock.Lock()
+	defer dc.gcLock.Unlock()
+
+	type entry struct {
+		filename string
+		size     int64
+		atime    time.Time
+	}
+	var entries []entry
+	var size int64
+	filepath.WalkDir(dc.root, func(filename string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if path.Base(filename)[0] == '.' {
+			// remove the temporary files left by crashes
+			if time.Since(fi.ModTime()) > time.Hour {
+				os.Remove(filename)
+			}
+			return nil
+		}
+		if expired, err := isDiskCacheFileExpired(filename); err != nil || expired {
+			os.Remove(filename)
+			return nil
+		}
+		entries = append(entries, entry{filename, fi.Size(), fi.ModTime()})
+		size += fi.Size()
+		return nil
+	})
+
+	if dc.maxSize > 0 && size > dc.maxSize {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].atime.Before(entries[j].atime)
+		})
+		for _, e := range entries {
+			if size <= dc.maxSize {
+				break
+			}
+			if os.Remove(e.filename) == nil {
+				size -= e.size
+			}
+		}
+	}
+	atomic.StoreInt64(&dc.size, size)
+}
+
+func isDiskCacheFileExpired(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var header [diskCacheHeaderSize]byte
+	_, err = io.ReadFull(f, header[:])
+	if err != nil {
+		return false, err
+	}
+	return isDiskCacheExpired(header[:]), nil
+}
+
+func isDiskCacheExpired(header []byte) bool {
+	expiredAt := int64(binary.BigEndian.Uint64(header))
+	return expiredAt > 0 && time.Now().UnixNano() > expiredAt
+}
+
+type diskCacheDriver struct{}
+
+// Open opens a disk cache, the url format is:
+// `disk:/path/to/cache?gcInterval=30m&maxSize=1GB`
+func (driver *diskCacheDriver) Open(root string, options url.Values) (Cache, error) {
+	if root == "" {
+		return nil, errors.New("missing cache directory")
+	}
+	root = filepath.Clean(root)
+	err := ensureDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	gcInterval, err := parseDurationValue(options.Get("gcInterval"), 30*time.Minute)
+	if err != nil {
+		return nil, errors.New("invalid gcInterval value")
+	}
+
+	maxSize, err := parseBytesValue(options.Get("maxSize"), 0)
+	if err != nil || maxSize < 0 {
+		return nil, errors.New("invalid maxSize value")
+	}
+
+	dc := &diskCache{
+		root:       root,
+		gcInterval: gcInterval,
+		maxSize:    maxSize,
+	}
+	// calculate the size and remove the expired entries
+	dc.sweep()
+	if gcInterval >= time.Second {
+		dc.gcTimer = time.AfterFunc(gcInterval, dc.gc)
+	}
+	return dc, nil
+}
+
+func init() {
+	RegisterCache("disk", &diskCacheDriver{})
+}
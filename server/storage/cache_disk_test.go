@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	root := t.TempDir()
+	cache, err := OpenCache("disk:" + root + "?gcInterval=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Set("key", []byte("hello world"), 0)
+	value, err := cache.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello world" {
+		t.Fatalf("invalid value(%v), shoud be 'hello world'", value)
+	}
+
+	cache.Set("key2", []byte("hello world"), 100*time.Millisecond)
+	ok, err := cache.Has("key2")
+	if err != nil || !ok {
+		t.Fatal("key2 should be existent")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = cache.Get("key2")
+	if err != ErrExpired {
+		t.Fatal("should be expired error, but", err)
+	}
+	_, err = cache.Get("key2")
+	if err != ErrNotFound {
+		t.Fatal("should be not found error, but", err)
+	}
+
+	// the entries survive restarts
+	cache, err = OpenCache("disk:" + root + "?gcInterval=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = cache.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello world" {
+		t.Fatalf("invalid value(%v), shoud be 'hello world'", value)
+	}
+
+	err = cache.Delete("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, _ = cache.Has("key")
+	if ok {
+		t.Fatal("key should be deleted")
+	}
+
+	cache.Set("key3", []byte("hello world"), 0)
+	err = cache.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.Get("key3")
+	if err != ErrNotFound {
+		t.Fatal("should be not found error, but", err)
+	}
+}
+
+func TestDiskCacheMaxSize(t *testing.T) {
+	cache, err := OpenCache("disk:" + t.TempDir() + "?gcInterval=0&maxSize=1KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := cache.(*diskCache)
+	if dc.maxSize != 1024 {
+		t.Fatalf("invalid max size %d, should be 1024", dc.maxSize)
+	}
+	// disable the eviction on set to control the access times
+	dc.maxSize = 0
+
+	// each entry takes 400 bytes including the header
+	for i, key := range []string{"a", "b", "c"} {
+		cache.Set(key, make([]byte, 392), 0)
+		at := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(dc.filename(key), at, at)
+	}
+	// touch `a` to make `b` the least recently used
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	dc.maxSize = 1024
+	dc.sweep()
+
+	if ok, _ := cache.Has("b"); ok {
+		t.Fatal("b should be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if ok, _ := cache.Has(key); !ok {
+			t.Fatalf("%s should be kept", key)
+		}
+	}
+	if dc.size != 800 {
+		t.Fatalf("invalid size %d, should be 800", dc.size)
+	}
+}
@@ -1,35 +1,51 @@
 package storage
 
 import (
+	"container/list"
 	"errors"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type mValue struct {
+	key       string
 	data      []byte
 	expiredAt int64
 }
 
-func (v mValue) isExpired() bool {
+func (v *mValue) isExpired() bool {
 	return v.expiredAt > 0 && time.Now().UnixNano() > v.expiredAt
 }
 
+func (v *mValue) size() int64 {
+	return int64(len(v.key) + len(v.data))
+}
+
+// mCache is a memory cache, the least recently used entries are evicted
+// if the `maxSize` or `maxEntries` is exceeded.
 type mCache struct {
-	lock       sync.RWMutex
+	lock       sync.Mutex
 	gcInterval time.Duration
 	gcTimer    *time.Timer
-	storage    map[string]mValue
+	maxSize    int64
+	maxEntries int
+	size       int64
+	storage    map[string]*list.Element
+	lru        *list.List // front is the most recently used
+	hits       uint64
+	misses     uint64
+	evictions  uint64
 }
 
 func (mc *mCache) Has(key string) (bool, error) {
-	mc.lock.RLock()
-	s, ok := mc.storage[key]
-	mc.lock.RUnlock()
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
 
-	if ok && s.isExpired() {
-		go mc.Delete(key)
+	e, ok := mc.storage[key]
+	if ok && e.Value.(*mValue).isExpired() {
+		mc.remove(e)
 		return false, nil
 	}
 
@@ -37,20 +53,26 @@ func (mc *mCache) Has(key string) (bool, error) {
 }
 
 func (mc *mCache) Get(key string) (value []byte, err error) {
-	mc.lock.RLock()
-	s, ok := mc.storage[key]
-	mc.lock.RUnlock()
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	e, ok := mc.storage[key]
 	if !ok {
+		mc.misses++
 		err = ErrNotFound
 		return
 	}
 
+	s := e.Value.(*mValue)
 	if s.isExpired() {
-		mc.Delete(key)
+		mc.remove(e)
+		mc.misses++
 		err = ErrExpired
 		return
 	}
 
+	mc.lru.MoveToFront(e)
+	mc.hits++
 	value = s.data
 	return
 }
@@ -59,11 +81,27 @@ func (mc *mCache) Set(key string, value []byte, ttl time.Duration) error {
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
+	s := &mValue{key: key, data: value}
 	if ttl > 0 {
-		mc.storage[key] = mValue{value, time.Now().Add(ttl).UnixNano()}
+		s.expiredAt = time.Now().Add(ttl).UnixNano()
+	}
+	if mc.maxSize > 0 && s.size() > mc.maxSize {
+		// the value is too large to be cached
+		if e, ok := mc.storage[key]; ok {
+			mc.remove(e)
+		}
+		return nil
+	}
+
+	if e, ok := mc.storage[key]; ok {
+		mc.size += s.size() - e.Value.(*mValue).size()
+		e.Value = s
+		mc.lru.MoveToFront(e)
 	} else {
-		mc.storage[key] = mValue{value, 0}
+		mc.storage[key] = mc.lru.PushFront(s)
+		mc.size += s.size()
 	}
+	mc.evict()
 	return nil
 }
 
@@ -71,7 +109,9 @@ func (mc *mCache) Delete(key string) error {
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	delete(mc.storage, key)
+	if e, ok := mc.storage[key]; ok {
+		mc.remove(e)
+	}
 	return nil
 }
 
@@ -79,34 +119,101 @@ func (mc *mCache) Flush() error {
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	mc.storage = map[string]mValue{}
+	mc.storage = map[string]*list.Element{}
+	mc.lru.Init()
+	mc.size = 0
 	return nil
 }
 
+// Stats returns the statistics of the cache.
+func (mc *mCache) Stats() CacheStats {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	return CacheStats{
+		Hits:      mc.hits,
+		Misses:    mc.misses,
+		Evictions: mc.evictions,
+		Entries:   len(mc.storage),
+		Size:      mc.size,
+	}
+}
+
+// evict removes the least recently used entries until the limits are satisfied,
+// the expired entries are removed first.
+func (mc *mCache) evict() {
+	if !mc.overflow() {
+		return
+	}
+	for e := mc.lru.Back(); e != nil && mc.overflow(); {
+		prev := e.Prev()
+		if e.Value.(*mValue).isExpired() {
+			mc.remove(e)
+		}
+		e = prev
+	}
+	for mc.overflow() {
+		e := mc.lru.Back()
+		if e == nil {
+			break
+		}
+		mc.remove(e)
+		mc.evictions++
+	}
+}
+
+func (mc *mCache) overflow() bool {
+	return (mc.maxSize > 0 && mc.size > mc.maxSize) || (mc.maxEntries > 0 && len(mc.storage) > mc.maxEntries)
+}
+
+func (mc *mCache) remove(e *list.Element) {
+	s := mc.lru.Remove(e).(*mValue)
+	delete(mc.storage, s.key)
+	mc.size -= s.size()
+}
+
 func (mc *mCache) gc() {
 	mc.gcTimer = time.AfterFunc(mc.gcInterval, mc.gc)
 
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	for key, d := range mc.storage {
-		if d.isExpired() {
-			delete(mc.storage, key)
+	for _, e := range mc.storage {
+		if e.Value.(*mValue).isExpired() {
+			mc.remove(e)
 		}
 	}
 }
 
 type mcDriver struct{}
 
+// Open opens a memory cache, the url format is:
+// `memory:default?gcInterval=30m&maxSize=256MB&maxEntries=100000`
 func (mcd *mcDriver) Open(region string, options url.Values) (Cache, error) {
 	gcInterval, err := parseDurationValue(options.Get("gcInterval"), 30*time.Minute)
 	if err != nil {
 		return nil, errors.New("invalid gcInterval value")
 	}
 
+	maxSize, err := parseBytesValue(options.Get("maxSize"), 0)
+	if err != nil || maxSize < 0 {
+		return nil, errors.New("invalid maxSize value")
+	}
+
+	maxEntries := 0
+	if v := options.Get("maxEntries"); v != "" {
+		maxEntries, err = strconv.Atoi(v)
+		if err != nil || maxEntries < 0 {
+			return nil, errors.New("invalid maxEntries value")
+		}
+	}
+
 	mc := &mCache{
-		storage:    map[string]mValue{},
+		storage:    map[string]*list.Element{},
+		lru:        list.New(),
 		gcInterval: gcInterval,
+		maxSize:    maxSize,
+		maxEntries: maxEntries,
 	}
 	if gcInterval >= time.Second {
 		mc.gcTimer = time.AfterFunc(gcInterval, mc.gc)
@@ -41,3 +41,64 @@ func TestMemCache(t *testing.T) {
 		t.Fatal("should be expired error, but", err)
 	}
 }
+
+func TestMemCacheLRU(t *testing.T) {
+	cache, err := OpenCache("memory:test?maxSize=1KB&maxEntries=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc, ok := cache.(*mCache)
+	if !ok {
+		t.Fatal("not a memory cache")
+	}
+	if mc.maxSize != 1024 || mc.maxEntries != 3 {
+		t.Fatalf("invalid limits %d/%d, should be 1024/3", mc.maxSize, mc.maxEntries)
+	}
+
+	cache.Set("a", []byte("a"), 0)
+	cache.Set("b", []byte("b"), 0)
+	cache.Set("c", []byte("c"), 0)
+	// touch `a` to make `b` the least recently used
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("d", []byte("d"), 0)
+	if _, err := cache.Get("b"); err != ErrNotFound {
+		t.Fatal("b should be evicted, but", err)
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, err := cache.Get(key); err != nil {
+			t.Fatalf("%s should be kept, but %v", key, err)
+		}
+	}
+
+	// the expired entries are evicted first
+	cache.Set("e", []byte("e"), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	cache.Set("f", []byte("f"), 0)
+	if ok, _ := cache.Has("c"); !ok {
+		t.Fatal("c should be kept")
+	}
+
+	// the size limit
+	cache.Set("g", make([]byte, 1000), 0)
+	stats := mc.Stats()
+	if stats.Entries != 3 || stats.Size != 1005 {
+		t.Fatalf("invalid stats %+v", stats)
+	}
+	if stats.Evictions != 3 || stats.Hits != 4 || stats.Misses != 1 {
+		t.Fatalf("invalid stats %+v", stats)
+	}
+
+	// the value larger than the max size is not cached
+	cache.Set("h", make([]byte, 2000), 0)
+	if ok, _ := cache.Has("h"); ok {
+		t.Fatal("h should not be cached")
+	}
+
+	cache.Flush()
+	if stats := mc.Stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Fatalf("invalid stats after flush %+v", stats)
+	}
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type redisCache struct {
+	client *redis.Client
+	prefix string
+}
+
+func (rc *redisCache) Has(key string) (bool, error) {
+	n, err := rc.client.Exists(context.Background(), rc.prefix+key).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (rc *redisCache) Get(key string) (value []byte, err error) {
+	value, err = rc.client.Get(context.Background(), rc.prefix+key).Bytes()
+	if err == redis.Nil {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (rc *redisCache) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		ttl = 0
+	}
+	return rc.client.Set(context.Background(), rc.prefix+key, value, ttl).Err()
+}
+
+func (rc *redisCache) Delete(key string) error {
+	return rc.client.Del(context.Background(), rc.prefix+key).Err()
+}
+
+// Flush removes all keys with the prefix, or flushes the whole db if the prefix is empty.
+func (rc *redisCache) Flush() error {
+	ctx := context.Background()
+	if rc.prefix == "" {
+		return rc.client.FlushDB(ctx).Err()
+	}
+
+	iter := rc.client.Scan(ctx, 0, rc.prefix+"*", 1000).Iterator()
+	keys := make([]string, 0, 1000)
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 1000 {
+			if err := rc.client.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return rc.client.Del(ctx, keys...).Err()
+	}
+	return nil
+}
+
+type redisDriver struct{}
+
+// Open opens a redis cache, the url format is:
+// `redis:localhost:6379?db=0&username=&password=&poolSize=10&prefix=esm:`
+func (rd *redisDriver) Open(addr string, options url.Values) (Cache, error) {
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+
+	db := 0
+	if v := options.Get("db"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			return nil, errors.New("invalid db value")
+		}
+		db = i
+	}
+
+	poolSize := 0 // use the default pool size of go-redis
+	if v := options.Get("poolSize"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			return nil, errors.New("invalid poolSize value")
+		}
+		poolSize = i
+	}
+
+	timeout, err := parseDurationValue(options.Get("timeout"), 3*time.Second)
+	if err != nil {
+		return nil, errors.New("invalid timeout value")
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:         addr,
+		Username:     options.Get("username"),
+		Password:     options.Get("password"),
+		DB:           db,
+		PoolSize:     poolSize,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = client.Ping(ctx).Err()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &redisCache{client, options.Get("prefix")}, nil
+}
+
+func init() {
+	RegisterCache("redis", &redisDriver{})
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisCache(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	cache, err := OpenCache("redis:" + s.Addr() + "?db=2&poolSize=4&prefix=esm:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, ok := cache.(*redisCache)
+	if !ok {
+		t.Fatal("not a redis cache")
+	}
+	if rc.prefix != "esm:" {
+		t.Fatalf("invalid prefix '%s', should be 'esm:'", rc.prefix)
+	}
+
+	cache.Set("key", []byte("hello world"), 0)
+	value, err := cache.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello world" {
+		t.Fatalf("invalid value(%v), shoud be 'hello world'", value)
+	}
+	s.Select(2)
+	if !s.Exists("esm:key") {
+		t.Fatal("key should be stored with prefix in db 2")
+	}
+
+	cache.Set("key2", []byte("hello world"), 3*time.Second)
+	ok, err = cache.Has("key2")
+	if err != nil || !ok {
+		t.Fatal("key2 should be existent")
+	}
+
+	s.FastForward(3 * time.Second)
+	_, err = cache.Get("key2")
+	if err != ErrNotFound {
+		t.Fatal("should be not found error, but", err)
+	}
+
+	s.Set("other", "value")
+	err = cache.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.Get("key")
+	if err != ErrNotFound {
+		t.Fatal("should be not found error, but", err)
+	}
+	if !s.Exists("other") {
+		t.Fatal("flush should not remove keys without the prefix")
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"errors"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/ije/gox/utils"
@@ -30,3 +31,21 @@ func parseDurationValue(str string, defaultValue time.Duration) (time.Duration,
 	}
 	return defaultValue, nil
 }
+
+func parseBytesValue(str string, defaultValue int64) (int64, error) {
+	if str != "" {
+		return utils.ParseBytes(str)
+	}
+	return defaultValue, nil
+}
+
+func parseBoolValue(options url.Values, key string, defaultValue bool) (bool, error) {
+	if !options.Has(key) {
+		return defaultValue, nil
+	}
+	if str := options.Get(key); str != "" {
+		return strconv.ParseBool(str)
+	}
+	// `?key` without value means `true`
+	return true, nil
+}
@@ -12,6 +12,11 @@ type DataBase interface {
 	Get(key string) ([]byte, error)
 	Put(key string, value []byte) error
 	Delete(key string) error
+	// List returns the keys with the given prefix in lexicographical order.
+	List(prefix string) (keys []string, err error)
+	// CompareAndSwap sets the value of the key to `new` if the current value equals `old` atomically,
+	// a nil `old` means the key must not exist, and a nil `new` deletes the key.
+	CompareAndSwap(key string, old []byte, new []byte) (swapped bool, err error)
 	Close() error
 }
 
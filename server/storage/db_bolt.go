@@ -1,18 +1,29 @@
 package storage
 
 import (
+	"bytes"
+	"fmt"
 	"net/url"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
 var defaultBucket = []byte("default")
 
+// openTimeout is the time to wait for the lock of the database file.
+const openTimeout = 5 * time.Second
+
 type boltDBDriver struct{}
 
 func (driver *boltDBDriver) Open(path string, options url.Values) (DataBase, error) {
-	db, err := bolt.Open(path, 0644, nil)
+	// the database file is locked exclusively by the opener, fail fast instead of blocking forever
+	// when it's held by another process, e.g. the running server
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: openTimeout})
 	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("the database %s is locked by another process (is the server running?)", path)
+		}
 		return nil, err
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
@@ -49,6 +60,35 @@ func (i *boltDB) Delete(key string) error {
 	})
 }
 
+func (i *boltDB) List(prefix string) (keys []string, err error) {
+	keys = []string{}
+	err = i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(defaultBucket).Cursor()
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return
+}
+
+func (i *boltDB) CompareAndSwap(key string, old []byte, new []byte) (swapped bool, err error) {
+	err = i.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(defaultBucket)
+		current := bucket.Get([]byte(key))
+		if (current == nil) != (old == nil) || !bytes.Equal(current, old) {
+			return nil
+		}
+		swapped = true
+		if new == nil {
+			return bucket.Delete([]byte(key))
+		}
+		return bucket.Put([]byte(key), new)
+	})
+	return
+}
+
 func (i *boltDB) Close() error {
 	return i.db.Close()
 }
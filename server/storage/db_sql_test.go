@@ -0,0 +1,18 @@
+//go:build cgo
+
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteDB(t *testing.T) {
+	db, err := OpenDB("sqlite:" + filepath.Join(t.TempDir(), "esm.db") + "?table=builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	testDB(t, db)
+}
@@ -0,0 +1,11 @@
+//go:build cgo
+
+package storage
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	RegisterDB("sqlite", &sqlDBDriver{sqliteDialect})
+}
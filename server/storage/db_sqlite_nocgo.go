@@ -0,0 +1,20 @@
+//go:build !cgo
+
+package storage
+
+import (
+	"errors"
+	"net/url"
+)
+
+// the sqlite driver requires cgo, this driver reports a clear error instead of the
+// "unknown driver" error of the server built with `CGO_ENABLED=0`.
+type sqliteNoCgoDriver struct{}
+
+func (sqliteNoCgoDriver) Open(dsn string, options url.Values) (DataBase, error) {
+	return nil, errors.New("sqlite is not supported by this build (CGO_ENABLED=0), rebuild the server with cgo or use the bolt/postgres database")
+}
+
+func init() {
+	RegisterDB("sqlite", sqliteNoCgoDriver{})
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSQLiteDBWithoutCgo(t *testing.T) {
+	_, err := OpenDB("sqlite:" + t.TempDir() + "/esm.db")
+	if err == nil || !strings.Contains(err.Error(), "CGO_ENABLED=0") {
+		t.Fatalf("expected the cgo error, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func testDB(t *testing.T, db DataBase) {
+	value, err := db.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil {
+		t.Fatal("value should be nil")
+	}
+
+	for _, key := range []string{
+		"v135/react@18.2.0/es2022/react.mjs",
+		"v135/react-dom@18.2.0/es2022/react-dom.mjs",
+		"v134/react@18.2.0/es2022/react.mjs",
+		"v136/react@18.2.0/es2022/react.mjs",
+		"publish-a",
+		"publish-b",
+		"publish_c",
+	} {
+		err = db.Put(key, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.Put("publish-a", []byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.Get("publish-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "bar" {
+		t.Fatalf("invalid value('%s'), should be 'bar'", value)
+	}
+
+	keys, err := db.List("v135/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "v135/react-dom@18.2.0/es2022/react-dom.mjs,v135/react@18.2.0/es2022/react.mjs" {
+		t.Fatalf("invalid keys %v", keys)
+	}
+
+	keys, err = db.List("publish-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "publish-a,publish-b" {
+		t.Fatalf("invalid keys %v", keys)
+	}
+
+	keys, err = db.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 7 {
+		t.Fatalf("invalid keys %v", keys)
+	}
+
+	ok, err := db.CompareAndSwap("cas", nil, []byte("a"))
+	if err != nil || !ok {
+		t.Fatal("should swap the non-existent key", err)
+	}
+	ok, err = db.CompareAndSwap("cas", nil, []byte("b"))
+	if err != nil || ok {
+		t.Fatal("should not swap the existent key", err)
+	}
+	ok, err = db.CompareAndSwap("cas", []byte("b"), []byte("c"))
+	if err != nil || ok {
+		t.Fatal("should not swap the key with a different value", err)
+	}
+	ok, err = db.CompareAndSwap("cas", []byte("a"), []byte("c"))
+	if err != nil || !ok {
+		t.Fatal("should swap the key with the same value", err)
+	}
+	value, err = db.Get("cas")
+	if err != nil || string(value) != "c" {
+		t.Fatalf("invalid value('%s'), should be 'c'", value)
+	}
+	ok, err = db.CompareAndSwap("cas", []byte("c"), nil)
+	if err != nil || !ok {
+		t.Fatal("should delete the key", err)
+	}
+	ok, err = db.CompareAndSwap("cas", nil, nil)
+	if err != nil || !ok {
+		t.Fatal("should swap the non-existent key", err)
+	}
+
+	err = db.Delete("publish-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.Get("publish-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil {
+		t.Fatal("value should be nil")
+	}
+}
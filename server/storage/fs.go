@@ -14,8 +14,26 @@ type FileSystem interface {
 	Stat(path string) (stat FileStat, err error)
 	OpenFile(path string) (content io.ReadSeekCloser, err error)
 	WriteFile(path string, r io.Reader) (written int64, err error)
+	// Remove removes the file, it's not an error if the file does not exist.
+	Remove(path string) error
+	// RemoveAll removes all the files under the directory prefix.
+	RemoveAll(prefix string) error
+	// Walk calls fn for each file under the directory prefix in lexical order,
+	// the walk stops if fn returns an error.
+	Walk(prefix string, fn WalkFunc) error
 }
 
+// TempFileWalker is implemented by the file systems that write the files via the temporary files,
+// the temporary files may be left behind by the crashed writes.
+type TempFileWalker interface {
+	// WalkTempFiles calls fn for each temporary file under the directory prefix.
+	WalkTempFiles(prefix string, fn WalkFunc) error
+}
+
+// WalkFunc is the type of the function called by `FileSystem.Walk` for each file,
+// the path is relative to the root of the file system.
+type WalkFunc func(path string, stat FileStat) error
+
 type FileStat interface {
 	Size() int64
 	ModTime() time.Time
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 )
 
 type localFSDriver struct{}
@@ -44,6 +45,8 @@ func (fs *localFSLayer) OpenFile(name string) (file io.ReadSeekCloser, err error
 	return
 }
 
+// WriteFile writes the content to a temporary file then renames it to the target path,
+// so readers never see a partially written file.
 func (fs *localFSLayer) WriteFile(name string, content io.Reader) (written int64, err error) {
 	fullPath := path.Join(fs.root, name)
 	err = ensureDir(path.Dir(fullPath))
@@ -51,16 +54,95 @@ func (fs *localFSLayer) WriteFile(name string, content io.Reader) (written int64
 		return
 	}
 
-	file, err := os.Create(fullPath)
+	file, err := os.CreateTemp(path.Dir(fullPath), ".tmp-*")
 	if err != nil {
 		return
 	}
-	defer file.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}()
 
 	written, err = io.Copy(file, content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if e := file.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(file.Name(), fullPath)
 	return
 }
 
+func (fs *localFSLayer) Remove(name string) error {
+	err := os.Remove(path.Join(fs.root, name))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *localFSLayer) RemoveAll(prefix string) error {
+	dir := path.Join(fs.root, prefix)
+	if dir == fs.root {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = os.RemoveAll(path.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
+
+func (fs *localFSLayer) Walk(prefix string, fn WalkFunc) error {
+	return fs.walk(prefix, false, fn)
+}
+
+// WalkTempFiles walks the temporary files of the writes, the `Remove` method removes them as well.
+func (fs *localFSLayer) WalkTempFiles(prefix string, fn WalkFunc) error {
+	return fs.walk(prefix, true, fn)
+}
+
+func (fs *localFSLayer) walk(prefix string, temp bool, fn WalkFunc) error {
+	dir := path.Join(fs.root, prefix)
+	return filepath.WalkDir(dir, func(fullPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") != temp {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		name, err := filepath.Rel(fs.root, fullPath)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(name), fi)
+	})
+}
+
 func ensureDir(dir string) (err error) {
 	_, err = os.Lstat(dir)
 	if err != nil && os.IsNotExist(err) {
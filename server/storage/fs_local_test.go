@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -66,3 +67,119 @@ func TestLocalFS(t *testing.T) {
 		t.Fatalf("File should be not existent")
 	}
 }
+
+func TestLocalFSRemoveAndWalk(t *testing.T) {
+	fs, err := OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFSRemoveAndWalk(t, fs)
+}
+
+func testFSRemoveAndWalk(t *testing.T, fs FileSystem) {
+	for _, name := range []string{
+		"builds/v135/react@18.2.0/es2022/react.mjs",
+		"builds/v135/react@18.2.0/es2022/react.mjs.map",
+		"builds/v135/react-dom@18.2.0/es2022/react-dom.mjs",
+		"builds/v136/react@18.2.0/es2022/react.mjs",
+		"publish/~abc/index.mjs",
+	} {
+		_, err := fs.WriteFile(name, bytes.NewBufferString(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(prefix string) string {
+		names := []string{}
+		err := fs.Walk(prefix, func(name string, stat FileStat) error {
+			if stat.Size() != int64(len(name)) {
+				t.Fatalf("invalid file size(%d) of '%s'", stat.Size(), name)
+			}
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(names, ",")
+	}
+
+	if ret := walk("builds/v135"); ret != "builds/v135/react-dom@18.2.0/es2022/react-dom.mjs,builds/v135/react@18.2.0/es2022/react.mjs,builds/v135/react@18.2.0/es2022/react.mjs.map" {
+		t.Fatalf("invalid walk result: %s", ret)
+	}
+	if ret := walk("builds/v13"); ret != "" {
+		t.Fatalf("walk should not match partial directory names: %s", ret)
+	}
+	if ret := walk("unknown"); ret != "" {
+		t.Fatalf("invalid walk result: %s", ret)
+	}
+
+	err := fs.Remove("builds/v135/react@18.2.0/es2022/react.mjs.map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Stat("builds/v135/react@18.2.0/es2022/react.mjs.map")
+	if err != ErrNotFound {
+		t.Fatal("file should be removed")
+	}
+	err = fs.Remove("builds/v135/react@18.2.0/es2022/react.mjs.map")
+	if err != nil {
+		t.Fatal("removing a non-existent file should not be an error, but", err)
+	}
+
+	err = fs.RemoveAll("builds/v135")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := walk(""); ret != "builds/v136/react@18.2.0/es2022/react.mjs,publish/~abc/index.mjs" {
+		t.Fatalf("invalid walk result: %s", ret)
+	}
+
+	err = fs.RemoveAll("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := walk(""); ret != "" {
+		t.Fatalf("invalid walk result: %s", ret)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	copy(p, "partial")
+	return len("partial"), io.ErrUnexpectedEOF
+}
+
+func TestLocalFSAtomicWrite(t *testing.T) {
+	root := t.TempDir()
+	fs, err := OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.WriteFile("a/foo.mjs", bytes.NewBufferString("export default 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.WriteFile("a/foo.mjs", failingReader{})
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("should be an unexpected EOF error, but", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "a/foo.mjs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "export default 1" {
+		t.Fatalf("the failed write should not change the file, but got '%s'", data)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("the temporary file should be removed, but got %d entries", len(entries))
+	}
+}
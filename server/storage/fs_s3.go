@@ -0,0 +1,426 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type s3FSDriver struct{}
+
+// Open opens a s3 compatible storage, the url format is:
+// `s3:bucket?region=us-east-1&prefix=esm&endpoint=http://localhost:9000&pathStyle`
+func (driver *s3FSDriver) Open(bucket string, options url.Values) (FileSystem, error) {
+	bucket = strings.Trim(bucket, "/")
+	if bucket == "" {
+		return nil, errors.New("missing bucket name")
+	}
+
+	region := options.Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := options.Get("endpoint")
+	if endpoint == "" {
+		endpoint = os.Getenv("S3_ENDPOINT")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "https://" + endpoint
+	}
+	endpointUrl, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %v", err)
+	}
+
+	pathStyle, err := parseBoolValue(options, "pathStyle", false)
+	if err != nil {
+		return nil, errors.New("invalid pathStyle value")
+	}
+
+	timeout, err := parseDurationValue(options.Get("timeout"), 30*time.Second)
+	if err != nil {
+		return nil, errors.New("invalid timeout value")
+	}
+
+	accessKeyID := options.Get("accessKeyId")
+	if accessKeyID == "" {
+		accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	secretAccessKey := options.Get("secretAccessKey")
+	if secretAccessKey == "" {
+		secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	sessionToken := options.Get("sessionToken")
+	if sessionToken == "" {
+		sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	return &s3FSLayer{
+		bucket:          bucket,
+		prefix:          strings.Trim(options.Get("prefix"), "/"),
+		region:          region,
+		endpoint:        endpointUrl,
+		pathStyle:       pathStyle,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		sessionToken:    sessionToken,
+		client:          &http.Client{Timeout: timeout},
+	}, nil
+}
+
+type s3FSLayer struct {
+	bucket          string
+	prefix          string
+	region          string
+	endpoint        *url.URL
+	pathStyle       bool
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	client          *http.Client
+}
+
+type s3FileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+func (fi *s3FileStat) Size() int64 {
+	return fi.size
+}
+
+func (fi *s3FileStat) ModTime() time.Time {
+	return fi.modTime
+}
+
+type s3File struct {
+	*bytes.Reader
+}
+
+func (f *s3File) Close() error {
+	return nil
+}
+
+func (fs *s3FSLayer) Stat(name string) (FileStat, error) {
+	res, err := fs.do(http.MethodHead, fs.objectKey(name), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return nil, ErrNotFound
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("s3: unexpected status %s", res.Status)
+	}
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &s3FileStat{res.ContentLength, modTime}, nil
+}
+
+func (fs *s3FSLayer) OpenFile(name string) (io.ReadSeekCloser, error) {
+	res, err := fs.do(http.MethodGet, fs.objectKey(name), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return nil, ErrNotFound
+	}
+	if res.StatusCode != 200 {
+		return nil, readS3Error(res)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{bytes.NewReader(data)}, nil
+}
+
+func (fs *s3FSLayer) WriteFile(name string, content io.Reader) (written int64, err error) {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return
+	}
+
+	header := http.Header{}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	res, err := fs.do(http.MethodPut, fs.objectKey(name), nil, header, data)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		err = readS3Error(res)
+		return
+	}
+	written = int64(len(data))
+	return
+}
+
+func (fs *s3FSLayer) Remove(name string) error {
+	res, err := fs.do(http.MethodDelete, fs.objectKey(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// s3 returns 204 even if the object does not exist
+	if res.StatusCode != 204 && res.StatusCode != 200 && res.StatusCode != 404 {
+		return readS3Error(res)
+	}
+	return nil
+}
+
+func (fs *s3FSLayer) RemoveAll(prefix string) error {
+	return fs.Walk(prefix, func(name string, stat FileStat) error {
+		return fs.Remove(name)
+	})
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+}
+
+// Walk lists the objects with the ListObjectsV2 API, the objects are returned in
+// lexicographical order of the UTF-8 binary key.
+func (fs *s3FSLayer) Walk(prefix string, fn WalkFunc) error {
+	keyPrefix := fs.objectKey(prefix)
+	if keyPrefix != "" {
+		keyPrefix += "/"
+	}
+	rootPrefix := ""
+	if fs.prefix != "" {
+		rootPrefix = fs.prefix + "/"
+	}
+
+	query := url.Values{"list-type": {"2"}}
+	if keyPrefix != "" {
+		query.Set("prefix", keyPrefix)
+	}
+	for {
+		res, err := fs.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != 200 {
+			err = readS3Error(res)
+			res.Body.Close()
+			return err
+		}
+		var ret s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&ret)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, obj := range ret.Contents {
+			err = fn(strings.TrimPrefix(obj.Key, rootPrefix), &s3FileStat{obj.Size, obj.LastModified})
+			if err != nil {
+				return err
+			}
+		}
+		if !ret.IsTruncated || ret.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", ret.NextContinuationToken)
+	}
+}
+
+func (fs *s3FSLayer) objectKey(name string) string {
+	return strings.TrimPrefix(path.Join("/", fs.prefix, name), "/")
+}
+
+func (fs *s3FSLayer) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *fs.endpoint
+	if fs.pathStyle {
+		u.Path = "/" + fs.bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u.Host = fs.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	if query != nil {
+		u.RawQuery = s3CanonicalQuery(query)
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+	fs.sign(req, body, time.Now().UTC())
+	return fs.client.Do(req)
+}
+
+// sign signs the request with AWS Signature Version 4,
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (fs *s3FSLayer) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if fs.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", fs.sessionToken)
+	}
+	if fs.accessKeyID == "" || fs.secretAccessKey == "" {
+		// anonymous request
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "x-amz-") || key == "content-type" {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for key := range headers {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	canonicalHeaders := bytes.NewBuffer(nil)
+	for _, key := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", key, headers[key])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, fs.region, "s3", "aws4_request"}, "/")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+fs.secretAccessKey), date)
+	key = hmacSHA256(key, fs.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		fs.accessKeyID,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3Escape(s string, keepSlash bool) string {
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func readS3Error(res *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	var code string
+	if i := bytes.Index(data, []byte("<Code>")); i >= 0 {
+		code = string(data[i+6:])
+		if j := strings.Index(code, "</Code>"); j >= 0 {
+			code = code[:j]
+		}
+	}
+	if code != "" {
+		return fmt.Errorf("s3: %s (%d)", code, res.StatusCode)
+	}
+	return fmt.Errorf("s3: unexpected status %s", res.Status)
+}
+
+func init() {
+	RegisterFileSystem("s3", &s3FSDriver{})
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal in-memory s3 server for testing, only the path-style requests are supported.
+type fakeS3 struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	pageSize int
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+		w.WriteHeader(403)
+		w.Write([]byte("<Error><Code>AccessDenied</Code></Error>"))
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.Contains(key, "/") && r.Method == "GET" && r.URL.Query().Get("list-type") == "2" {
+		s.list(w, key, r.URL.Query())
+		return
+	}
+	switch r.Method {
+	case "HEAD", "GET":
+		data, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(200)
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case "PUT":
+		data, _ := io.ReadAll(r.Body)
+		s.objects[key] = data
+		w.WriteHeader(200)
+	case "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, bucket string, query map[string][]string) {
+	get := func(key string) string {
+		if v := query[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	prefix := bucket + "/" + get("prefix")
+	keys := []string{}
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > bucket+"/"+get("continuation-token") {
+			keys = append(keys, strings.TrimPrefix(key, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+
+	type object struct {
+		Key          string
+		LastModified string
+		Size         int
+	}
+	var ret struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []object
+	}
+	if s.pageSize > 0 && len(keys) > s.pageSize {
+		keys = keys[:s.pageSize]
+		ret.IsTruncated = true
+		ret.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		ret.Contents = append(ret.Contents, object{key, time.Now().UTC().Format(time.RFC3339), len(s.objects[bucket+"/"+key])})
+	}
+	w.WriteHeader(200)
+	xml.NewEncoder(w).Encode(ret)
+}
+
+func TestS3FS(t *testing.T) {
+	s3 := &fakeS3{objects: map[string][]byte{}, pageSize: 2}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	fs, err := OpenFS("s3:test-bucket?prefix=esm&pathStyle&accessKeyId=test&secretAccessKey=secret&endpoint=" + server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sfs, ok := fs.(*s3FSLayer)
+	if !ok {
+		t.Fatal("not a s3 FS")
+	}
+	if sfs.bucket != "test-bucket" || sfs.prefix != "esm" || !sfs.pathStyle {
+		t.Fatalf("invalid s3 options %+v", sfs)
+	}
+
+	n, err := fs.WriteFile("builds/react@18.2.0/es2022/react.mjs", bytes.NewBufferString("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("invalid written(%d), shoud be 3", n)
+	}
+	if _, ok := s3.objects["test-bucket/esm/builds/react@18.2.0/es2022/react.mjs"]; !ok {
+		t.Fatal("object not stored with the bucket and prefix")
+	}
+
+	fi, err := fs.Stat("builds/react@18.2.0/es2022/react.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 3 {
+		t.Fatalf("invalid file size(%d), shoud be 3", fi.Size())
+	}
+
+	f, err := fs.OpenFile("builds/react@18.2.0/es2022/react.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "bar" {
+		t.Fatalf("invalid file content('%s'), shoud be 'bar'", string(data))
+	}
+
+	_, err = fs.Stat("fo0.txt")
+	if err != ErrNotFound {
+		t.Fatalf("File should be not existent")
+	}
+
+	_, err = fs.OpenFile("fo0.txt")
+	if err != ErrNotFound {
+		t.Fatalf("File should be not existent")
+	}
+
+	err = fs.Remove("builds/react@18.2.0/es2022/react.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFSRemoveAndWalk(t, fs)
+	if len(s3.objects) != 0 {
+		t.Fatalf("all objects should be removed, but got %d", len(s3.objects))
+	}
+}
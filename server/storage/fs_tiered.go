@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tieredFSDriver struct{}
+
+// Open opens a tiered file system that keeps a bounded local read-through cache of
+// the hot files in front of the backend file system, the url format is:
+// `tiered:local:/var/cache/esm?backend=s3%3Abucket%3Fregion%3Dus-east-1&maxSize=20GB`
+// The backend url should be url-encoded if it contains `?` or `&`.
+// The cached files keep the modification time of the backend, so the `Last-Modified` of a file is
+// the same on every server. The lru order is kept in memory only, the cached files are ordered by
+// the modification time after restart.
+func (driver *tieredFSDriver) Open(root string, options url.Values) (FileSystem, error) {
+	root = strings.TrimPrefix(root, "local:")
+	if root == "" {
+		return nil, errors.New("missing cache directory")
+	}
+	root = filepath.Clean(root)
+	err := ensureDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	backendUrl := options.Get("backend")
+	if backendUrl == "" {
+		return nil, errors.New("missing backend")
+	}
+	if strings.HasPrefix(backendUrl, "tiered:") {
+		return nil, errors.New("invalid backend")
+	}
+	backend, err := OpenFS(backendUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	maxSize, err := parseBytesValue(options.Get("maxSize"), 10*1024*1024*1024)
+	if err != nil || maxSize <= 0 {
+		return nil, errors.New("invalid maxSize value")
+	}
+
+	fs := &tieredFSLayer{
+		root:    root,
+		backend: backend,
+		maxSize: maxSize,
+		index:   map[string]*list.Element{},
+		lru:     list.New(),
+	}
+	err = fs.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+type tieredFSLayer struct {
+	root    string
+	backend FileSystem
+	maxSize int64
+	lock    sync.Mutex
+	size    int64
+	index   map[string]*list.Element
+	lru     *list.List // front is the most recently used
+}
+
+type tieredEntry struct {
+	name string
+	size int64
+}
+
+// Stat returns the stat of the cached file if it's cached, the modification time of the cached
+// file is the one of the backend.
+func (fs *tieredFSLayer) Stat(name string) (FileStat, error) {
+	name = cleanFSPath(name)
+	if fs.touch(name) {
+		fi, err := os.Lstat(path.Join(fs.root, name))
+		if err == nil {
+			return fi, nil
+		}
+		fs.forget(name)
+	}
+	return fs.backend.Stat(name)
+}
+
+func (fs *tieredFSLayer) OpenFile(name string) (io.ReadSeekCloser, error) {
+	name = cleanFSPath(name)
+	if fs.touch(name) {
+		file, err := os.Open(path.Join(fs.root, name))
+		if err == nil {
+			return file, nil
+		}
+		fs.forget(name)
+	}
+
+	fi, err := fs.backend.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fs.backend.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.cache(name, r, fi.ModTime())
+	r.Close()
+	if err != nil {
+		// fallback to the backend
+		return fs.backend.OpenFile(name)
+	}
+	file, err := os.Open(path.Join(fs.root, name))
+	if err != nil {
+		return fs.backend.OpenFile(name)
+	}
+	return file, nil
+}
+
+// WriteFile writes the file to the backend, and keeps a copy in the local cache.
+func (fs *tieredFSLayer) WriteFile(name string, content io.Reader) (written int64, err error) {
+	name = cleanFSPath(name)
+	tmp, err := fs.createTemp(name)
+	if err != nil {
+		return fs.backend.WriteFile(name, content)
+	}
+
+	// the failure of the local cache should not break the write
+	w := &cacheWriter{w: tmp}
+	written, err = fs.backend.WriteFile(name, io.TeeReader(content, w))
+	tmp.Close()
+	if err != nil || w.err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	fi, e := fs.backend.Stat(name)
+	if e != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	fs.commit(name, tmp.Name(), written, fi.ModTime())
+	return
+}
+
+func (fs *tieredFSLayer) Remove(name string) error {
+	name = cleanFSPath(name)
+	fs.forget(name)
+	return fs.backend.Remove(name)
+}
+
+func (fs *tieredFSLayer) RemoveAll(prefix string) error {
+	prefix = cleanFSPath(prefix)
+	fs.lock.Lock()
+	for name, e := range fs.index {
+		if prefix == "" || strings.HasPrefix(name, prefix+"/") {
+			fs.remove(e)
+		}
+	}
+	fs.lock.Unlock()
+	return fs.backend.RemoveAll(prefix)
+}
+
+// WalkTempFiles walks the temporary files of the backend file system.
+func (fs *tieredFSLayer) WalkTempFiles(prefix string, fn WalkFunc) error {
+	if w, ok := fs.backend.(TempFileWalker); ok {
+		return w.WalkTempFiles(prefix, fn)
+	}
+	return nil
+}
+
+// Walk walks the backend file system that is the source of truth.
+func (fs *tieredFSLayer) Walk(prefix string, fn WalkFunc) error {
+	return fs.backend.Walk(prefix, fn)
+}
+
+// cache copies the content to the local cache.
+func (fs *tieredFSLayer) cache(name string, r io.Reader, modTime time.Time) error {
+	tmp, err := fs.createTemp(name)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tmp, r)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if !fs.commit(name, tmp.Name(), n, modTime) {
+		return errors.New("file is too large to be cached")
+	}
+	return nil
+}
+
+func (fs *tieredFSLayer) createTemp(name string) (*os.File, error) {
+	dir := path.Dir(path.Join(fs.root, name))
+	err := ensureDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, ".tmp-*")
+}
+
+// commit moves the temporary file to the cache path and adds it to the index,
+// the least recently used files are evicted if the total size exceeds the `maxSize`.
+// The modification time of the backend is preserved and never changed afterwards.
+func (fs *tieredFSLayer) commit(name string, tmpPath string, size int64, modTime time.Time) bool {
+	if size > fs.maxSize || os.Chtimes(tmpPath, modTime, modTime) != nil {
+		os.Remove(tmpPath)
+		return false
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if os.Rename(tmpPath, path.Join(fs.root, name)) != nil {
+		os.Remove(tmpPath)
+		return false
+	}
+	if e, ok := fs.index[name]; ok {
+		fs.size += size - e.Value.(*tieredEntry).size
+		e.Value.(*tieredEntry).size = size
+		fs.lru.MoveToFront(e)
+	} else {
+		fs.index[name] = fs.lru.PushFront(&tieredEntry{name, size})
+		fs.size += size
+	}
+	for fs.size > fs.maxSize {
+		e := fs.lru.Back()
+		if e == nil {
+			break
+		}
+		fs.remove(e)
+	}
+	return true
+}
+
+// touch marks the file as recently used, returns false if the file is not cached.
+func (fs *tieredFSLayer) touch(name string) bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	e, ok := fs.index[name]
+	if ok {
+		fs.lru.MoveToFront(e)
+	}
+	return ok
+}
+
+func (fs *tieredFSLayer) forget(name string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if e, ok := fs.index[name]; ok {
+		fs.remove(e)
+	}
+}
+
+func (fs *tieredFSLayer) remove(e *list.Element) {
+	entry := fs.lru.Remove(e).(*tieredEntry)
+	delete(fs.index, entry.name)
+	fs.size -= entry.size
+	os.Remove(path.Join(fs.root, entry.name))
+}
+
+// loadIndex loads the cached files ordered by the modification time.
+func (fs *tieredFSLayer) loadIndex() error {
+	type file struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	err := filepath.WalkDir(fs.root, func(fullPath string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			os.Remove(fullPath)
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		name, err := filepath.Rel(fs.root, fullPath)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{filepath.ToSlash(name), fi.Size(), fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+	for _, f := range files {
+		fs.index[f.name] = fs.lru.PushBack(&tieredEntry{f.name, f.size})
+		fs.size += f.size
+	}
+	for fs.size > fs.maxSize {
+		fs.remove(fs.lru.Back())
+	}
+	return nil
+}
+
+// cacheWriter is a writer that never fails, the error is recorded.
+type cacheWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if cw.err == nil {
+		_, cw.err = cw.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func cleanFSPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func init() {
+	RegisterFileSystem("tiered", &tieredFSDriver{})
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTieredFS(t *testing.T) {
+	cacheDir := t.TempDir()
+	backendDir := t.TempDir()
+	fs, err := OpenFS("tiered:local:" + cacheDir + "?maxSize=10&backend=" + url.QueryEscape("local:"+backendDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tfs, ok := fs.(*tieredFSLayer)
+	if !ok {
+		t.Fatal("not a tiered FS")
+	}
+	if tfs.root != cacheDir || tfs.maxSize != 10 {
+		t.Fatalf("invalid tiered options %+v", tfs)
+	}
+
+	readFile := func(name string) string {
+		f, err := fs.OpenFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	isCached := func(name string) bool {
+		_, err := os.Stat(path.Join(cacheDir, name))
+		return err == nil
+	}
+
+	// write through
+	_, err = fs.WriteFile("a/foo.txt", bytes.NewBufferString("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path.Join(backendDir, "a/foo.txt")); string(data) != "foo" {
+		t.Fatal("the file should be written to the backend")
+	}
+	if !isCached("a/foo.txt") {
+		t.Fatal("the file should be cached")
+	}
+
+	// read through
+	os.WriteFile(path.Join(backendDir, "bar.txt"), []byte("bar"), 0644)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(path.Join(backendDir, "bar.txt"), modTime, modTime)
+	if readFile("bar.txt") != "bar" {
+		t.Fatal("invalid file content")
+	}
+	if !isCached("bar.txt") {
+		t.Fatal("the file should be cached")
+	}
+
+	// the cached files keep the modification time of the backend
+	readFile("bar.txt")
+	if fi, err := fs.Stat("bar.txt"); err != nil || !fi.ModTime().Equal(modTime) {
+		t.Fatalf("the modification time should be the one of the backend")
+	}
+	backendFi, _ := os.Stat(path.Join(backendDir, "a/foo.txt"))
+	if fi, err := fs.Stat("a/foo.txt"); err != nil || !fi.ModTime().Equal(backendFi.ModTime()) {
+		t.Fatalf("the modification time should be the one of the backend")
+	}
+
+	// lru eviction by size
+	readFile("a/foo.txt")
+	_, err = fs.WriteFile("baz.txt", bytes.NewBufferString("bazbaz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isCached("bar.txt") {
+		t.Fatal("the least recently used file should be evicted")
+	}
+	if !isCached("a/foo.txt") || !isCached("baz.txt") {
+		t.Fatal("the recently used files should be kept")
+	}
+	if readFile("bar.txt") != "bar" {
+		t.Fatal("the evicted file should be read from the backend")
+	}
+
+	// the file larger than the max size is not cached
+	_, err = fs.WriteFile("large.txt", bytes.NewBufferString("0123456789abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isCached("large.txt") {
+		t.Fatal("the large file should not be cached")
+	}
+	if readFile("large.txt") != "0123456789abc" {
+		t.Fatal("invalid file content")
+	}
+
+	// the index is restored after restart
+	fs, err = OpenFS("tiered:local:" + cacheDir + "?maxSize=10&backend=" + url.QueryEscape("local:"+backendDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.(*tieredFSLayer).size != tfs.size {
+		t.Fatalf("invalid cache size %d, should be %d", fs.(*tieredFSLayer).size, tfs.size)
+	}
+
+	err = fs.RemoveAll("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isCached("a/foo.txt") {
+		t.Fatal("the file should be removed from the cache")
+	}
+	_, err = fs.Stat("a/foo.txt")
+	if err != ErrNotFound {
+		t.Fatal("the file should be removed from the backend")
+	}
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrLocked = errors.New("locked")
+
+// Locker provides the leases of keys to coordinate the work across the server instances.
+// A lease is kept alive until it's unlocked, and it expires after the ttl if the holder dies.
+type Locker interface {
+	// TryLock acquires the lease of the key, returns `ErrLocked` if the lease is held by others.
+	TryLock(key string, ttl time.Duration) (Lease, error)
+	// Lock acquires the lease of the key, it blocks until the lease is acquired or the context is done.
+	Lock(ctx context.Context, key string, ttl time.Duration) (Lease, error)
+}
+
+type Lease interface {
+	// Unlock releases the lease.
+	Unlock() error
+}
+
+// lockWithRetry calls the tryLock function until the lease is acquired or the context is done.
+func lockWithRetry(ctx context.Context, tryLock func() (Lease, error)) (Lease, error) {
+	delay := 50 * time.Millisecond
+	for {
+		lease, err := tryLock()
+		if err != ErrLocked {
+			return lease, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
+
+type memoryLocker struct {
+	lock   sync.Mutex
+	leases map[string]*memoryLease
+}
+
+// NewMemoryLocker returns a process-local locker.
+func NewMemoryLocker() Locker {
+	return &memoryLocker{leases: map[string]*memoryLease{}}
+}
+
+type memoryLease struct {
+	locker *memoryLocker
+	key    string
+}
+
+// TryLock acquires the lease of the key, the ttl is ignored since the holder lives in the same
+// process, the lease is held until it's unlocked.
+func (ml *memoryLocker) TryLock(key string, ttl time.Duration) (Lease, error) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	if _, ok := ml.leases[key]; ok {
+		return nil, ErrLocked
+	}
+	l := &memoryLease{locker: ml, key: key}
+	ml.leases[key] = l
+	return l, nil
+}
+
+func (ml *memoryLocker) Lock(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	return lockWithRetry(ctx, func() (Lease, error) {
+		return ml.TryLock(key, ttl)
+	})
+}
+
+func (l *memoryLease) Unlock() error {
+	l.locker.lock.Lock()
+	defer l.locker.lock.Unlock()
+
+	if l.locker.leases[l.key] == l {
+		delete(l.locker.leases, l.key)
+	}
+	return nil
+}
+
+// dbLocker stores the leases in the database with the `lock-` key prefix, it requires a
+// database that is shared by the server instances, like postgres.
+type dbLocker struct {
+	db    DataBase
+	owner string
+}
+
+// NewDBLocker returns a locker that stores the leases in the database.
+func NewDBLocker(db DataBase) Locker {
+	return &dbLocker{db: db, owner: randomToken()}
+}
+
+type dbLeaseRecord struct {
+	Owner     string `json:"o"`
+	ExpiresAt int64  `json:"e"`
+}
+
+type dbLease struct {
+	locker *dbLocker
+	key    string
+	ttl    time.Duration
+	lock   sync.Mutex
+	value  []byte
+	done   chan struct{}
+}
+
+func (dl *dbLocker) TryLock(key string, ttl time.Duration) (Lease, error) {
+	key = "lock-" + key
+	current, err := dl.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		var record dbLeaseRecord
+		if json.Unmarshal(current, &record) == nil && time.Now().UnixMilli() < record.ExpiresAt {
+			return nil, ErrLocked
+		}
+	}
+
+	value := dl.newRecord(ttl)
+	ok, err := dl.db.CompareAndSwap(key, current, value)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+
+	lease := &dbLease{locker: dl, key: key, ttl: ttl, value: value, done: make(chan struct{})}
+	go lease.keepAlive()
+	return lease, nil
+}
+
+func (dl *dbLocker) Lock(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	return lockWithRetry(ctx, func() (Lease, error) {
+		return dl.TryLock(key, ttl)
+	})
+}
+
+func (dl *dbLocker) newRecord(ttl time.Duration) []byte {
+	// the token makes every record unique for the compare-and-swap
+	data, _ := json.Marshal(dbLeaseRecord{
+		Owner:     dl.owner + "-" + randomToken(),
+		ExpiresAt: time.Now().Add(ttl).UnixMilli(),
+	})
+	return data
+}
+
+// keepAlive extends the lease before it expires until it's unlocked.
+func (l *dbLease) keepAlive() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.lock.Lock()
+			value := l.locker.newRecord(l.ttl)
+			ok, err := l.locker.db.CompareAndSwap(l.key, l.value, value)
+			if err == nil && ok {
+				l.value = value
+			}
+			l.lock.Unlock()
+			if err == nil && !ok {
+				// the lease is lost
+				return
+			}
+		}
+	}
+}
+
+func (l *dbLease) Unlock() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	select {
+	case <-l.done:
+		return nil
+	default:
+		close(l.done)
+	}
+	_, err := l.locker.db.CompareAndSwap(l.key, l.value, nil)
+	return err
+}
+
+func randomToken() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryLocker(t *testing.T) {
+	testLocker(t, NewMemoryLocker())
+}
+
+func TestDBLocker(t *testing.T) {
+	db, err := OpenDB("bolt:" + filepath.Join(t.TempDir(), "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	locker := NewDBLocker(db)
+	testLocker(t, locker)
+
+	// the lease is kept alive
+	lease, err := locker.TryLock("foo", 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	other := NewDBLocker(db)
+	_, err = other.TryLock("foo", time.Second)
+	if err != ErrLocked {
+		t.Fatal("the lease should be kept alive, but", err)
+	}
+	lease.Unlock()
+	value, _ := db.Get("lock-foo")
+	if value != nil {
+		t.Fatal("the lease record should be removed")
+	}
+
+	// the expired lease of a dead instance can be taken over
+	db.Put("lock-bar", []byte(`{"o":"dead","e":1}`))
+	lease, err = other.TryLock("bar", time.Second)
+	if err != nil {
+		t.Fatal("the expired lease should be taken over, but", err)
+	}
+	lease.Unlock()
+}
+
+func testLocker(t *testing.T, locker Locker) {
+	lease, err := locker.TryLock("foo", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = locker.TryLock("foo", time.Second)
+	if err != ErrLocked {
+		t.Fatal("should be locked error, but", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = locker.Lock(ctx, "foo", time.Second)
+	if err != context.DeadlineExceeded {
+		t.Fatal("should be deadline exceeded error, but", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lease.Unlock()
+	}()
+	lease, err = locker.Lock(context.Background(), "foo", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lease.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
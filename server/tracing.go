@@ -0,0 +1,466 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+// The tracing of the build pipeline. The trace context follows the W3C `traceparent` header, it's
+// propagated from the module request through the build queue (and to the remote workers) to the
+// build stages. The spans are exported in the OTLP json format to an OTLP/HTTP collector, or to a
+// json-lines file for the offline use.
+//
+// A span is only started in a context that carries a parent span, except the root spans of the
+// requests and the builds, so the callers don't need to check if the tracing is enabled.
+
+// the span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// the max number of the spans to buffer, the spans are dropped if the exporter can't keep up
+const traceBufferSize = 4096
+
+// the max number of the spans to export in a batch
+const traceBatchSize = 256
+
+// the interval to export the buffered spans
+const traceFlushInterval = 5 * time.Second
+
+// the tracer of the server, nil if the tracing is disabled
+var tracer *Tracer
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+func (sc spanContext) isValid() bool {
+	return sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+// traceparent returns the W3C `traceparent` header of the span context.
+func (sc spanContext) traceparent() string {
+	if !sc.isValid() {
+		return ""
+	}
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.traceID[:]), hex.EncodeToString(sc.spanID[:]), flags)
+}
+
+// parseTraceparent parses the W3C `traceparent` header, e.g. `00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01`.
+func parseTraceparent(s string) (sc spanContext, ok bool) {
+	a := strings.Split(strings.TrimSpace(s), "-")
+	if len(a) < 4 || len(a[0]) != 2 || a[0] == "ff" || (a[0] == "00" && len(a) != 4) {
+		return
+	}
+	if len(a[1]) != 32 || len(a[2]) != 16 || len(a[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(a[1])); err != nil {
+		return spanContext{}, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(a[2])); err != nil {
+		return spanContext{}, false
+	}
+	flags, err := hex.DecodeString(a[3])
+	if err != nil {
+		return spanContext{}, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, sc.isValid()
+}
+
+type spanKey struct{}
+
+// Span is a span of the trace, the methods are no-op on a nil span.
+type Span struct {
+	lock     sync.Mutex
+	sc       spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	attrs    map[string]interface{}
+	ended    bool
+}
+
+func newSpan(parent spanContext, name string, kind int, attrs []interface{}) *Span {
+	s := &Span{
+		sc:       spanContext{traceID: parent.traceID, sampled: true},
+		parentID: parent.spanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    map[string]interface{}{},
+	}
+	rand.Read(s.sc.spanID[:])
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if key, ok := attrs[i].(string); ok {
+			s.attrs[key] = attrs[i+1]
+		}
+	}
+	return s
+}
+
+// spanFromContext returns the span of the context, or nil.
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// startSpan starts a child span of the span in the context, the attributes are key-value pairs. It
+// returns the context as is and a nil span if the context doesn't carry a span.
+func startSpan(ctx context.Context, name string, attrs ...interface{}) (context.Context, *Span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := newSpan(parent.sc, name, spanKindInternal, attrs)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startRootSpan starts a span of the remote parent, a new trace is started if the parent is invalid.
+// It returns the context as is and a nil span if the tracing is disabled or the parent is not sampled.
+func startRootSpan(ctx context.Context, parent spanContext, name string, kind int, attrs ...interface{}) (context.Context, *Span) {
+	if tracer == nil || (parent.isValid() && !parent.sampled) {
+		return ctx, nil
+	}
+	if !parent.isValid() {
+		parent = spanContext{}
+		rand.Read(parent.traceID[:])
+	}
+	s := newSpan(parent, name, kind, attrs)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Context returns the span context of the span.
+func (s *Span) Context() spanContext {
+	if s == nil {
+		return spanContext{}
+	}
+	return s.sc
+}
+
+// SetAttr sets the attribute of the span.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.attrs[key] = value
+	s.lock.Unlock()
+}
+
+// End ends the span, the error is recorded as the status of the span.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.ended {
+		return
+	}
+	s.ended = true
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.traceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        toOtlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if err != nil {
+		span.Status = otlpStatus{Code: 2, Message: err.Error()}
+	}
+	tracer.export(span)
+}
+
+// startRequestSpan starts the root span of the request, the `traceparent` header of the client
+// is respected. The context of the request carries the span.
+func startRequestSpan(ctx *rex.Context) *Span {
+	parent, _ := parseTraceparent(ctx.R.Header.Get("traceparent"))
+	reqCtx, span := startRootSpan(
+		ctx.R.Context(),
+		parent,
+		ctx.R.Method+" "+getRouteClass(ctx.R.Method, ctx.Path.String()),
+		spanKindServer,
+		"http.method", ctx.R.Method,
+		"http.target", ctx.R.RequestURI,
+		"http.user_agent", ctx.R.UserAgent(),
+	)
+	if span != nil {
+		ctx.R = ctx.R.WithContext(reqCtx)
+	}
+	return span
+}
+
+// writeStorageFile writes the file to the storage in the `storage.WriteFile` span.
+func writeStorageFile(ctx context.Context, name string, r io.Reader) (written int64, err error) {
+	_, span := startSpan(ctx, "storage.WriteFile", "name", name)
+	written, err = fs.WriteFile(name, r)
+	span.SetAttr("size", written)
+	span.End(err)
+	return
+}
+
+// the OTLP json types, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpTracesData struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func toOtlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	kvs := make([]otlpKeyValue, len(keys))
+	for i, key := range keys {
+		kvs[i] = otlpKeyValue{Key: key, Value: toOtlpValue(attrs[key])}
+	}
+	return kvs
+}
+
+func toOtlpValue(v interface{}) otlpAnyValue {
+	var s string
+	switch v := v.(type) {
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case int:
+		s = strconv.Itoa(v)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s = strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	case string:
+		s = v
+	default:
+		s = fmt.Sprint(v)
+	}
+	return otlpAnyValue{StringValue: &s}
+}
+
+// Tracer exports the spans in batches.
+type Tracer struct {
+	config config.Tracing
+	client *http.Client
+	file   *os.File
+	lock   sync.RWMutex
+	spans  chan otlpSpan
+	closed bool
+	done   chan struct{}
+}
+
+func newTracer(c config.Tracing) (*Tracer, error) {
+	t := &Tracer{
+		config: c,
+		client: &http.Client{Timeout: 10 * time.Second},
+		spans:  make(chan otlpSpan, traceBufferSize),
+		done:   make(chan struct{}),
+	}
+	if c.File != "" {
+		if err := ensureDir(path.Dir(c.File)); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		t.file = f
+	}
+	go t.loop()
+	return t, nil
+}
+
+// export queues the span to export, it never blocks.
+func (t *Tracer) export(span otlpSpan) {
+	if t == nil {
+		return
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- span:
+	default:
+	}
+}
+
+func (t *Tracer) loop() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]otlpSpan, 0, traceBatchSize)
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				t.flush(batch)
+				close(t.done)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= traceBatchSize {
+				t.flush(batch)
+				batch = make([]otlpSpan, 0, traceBatchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				t.flush(batch)
+				batch = make([]otlpSpan, 0, traceBatchSize)
+			}
+		}
+	}
+}
+
+func (t *Tracer) flush(spans []otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	serviceName := t.config.ServiceName
+	data, err := json.Marshal(otlpTracesData{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: &serviceName}}},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "esm.sh", Version: fmt.Sprintf("v%d", VERSION)},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Errorf("tracing: %v", err)
+		return
+	}
+
+	if t.file != nil {
+		if _, err := t.file.Write(append(data, '\n')); err != nil {
+			log.Warnf("tracing: write %s: %v", t.config.File, err)
+		}
+	}
+
+	if t.config.OtlpEndpoint != "" {
+		req, err := http.NewRequest("POST", t.config.OtlpEndpoint, bytes.NewReader(data))
+		if err != nil {
+			log.Warnf("tracing: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range t.config.OtlpHeaders {
+			req.Header.Set(key, value)
+		}
+		res, err := t.client.Do(req)
+		if err != nil {
+			log.Warnf("tracing: export %d spans: %v", len(spans), err)
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode >= 300 {
+			msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+			log.Warnf("tracing: export %d spans: %s %s", len(spans), res.Status, msg)
+		}
+	}
+}
+
+// Close exports the buffered spans and stops the tracer.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.spans)
+	t.lock.Unlock()
+
+	<-t.done
+	if t.file != nil {
+		t.file.Close()
+	}
+}
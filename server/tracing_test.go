@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := parseTraceparent(header)
+	if !ok || !sc.sampled || sc.traceparent() != header {
+		t.Fatalf("unexpected span context of '%s': %+v", header, sc)
+	}
+	if sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); !ok || sc.sampled {
+		t.Fatal("expected the unsampled span context")
+	}
+	for _, s := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(s); ok {
+			t.Fatalf("expected '%s' to be invalid", s)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	defer func() { tracer = nil }()
+
+	// the spans are not started if the tracing is disabled
+	tracer = nil
+	if _, span := startRootSpan(context.Background(), spanContext{}, "build", spanKindInternal); span != nil {
+		t.Fatal("expected no span if the tracing is disabled")
+	}
+
+	var received otlpTracesData
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(401)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+		close(done)
+	}))
+	defer server.Close()
+
+	file := path.Join(t.TempDir(), "traces/spans.jsonl")
+	var err error
+	tracer, err = newTracer(config.Tracing{
+		OtlpEndpoint: server.URL,
+		OtlpHeaders:  map[string]string{"X-Api-Key": "secret"},
+		File:         file,
+		ServiceName:  "esm.sh",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the unsampled remote parent is respected
+	unsampled, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if _, span := startRootSpan(context.Background(), unsampled, "build", spanKindInternal); span != nil {
+		t.Fatal("expected no span of the unsampled parent")
+	}
+	// the child span is not started without parent
+	if _, span := startSpan(context.Background(), "esbuild"); span != nil {
+		t.Fatal("expected no span without parent")
+	}
+
+	parent, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := startRootSpan(context.Background(), parent, "build", spanKindInternal, "build.id", "v135/react@18.2.0/es2022/react.mjs")
+	_, child := startSpan(ctx, "esbuild", "bundle", true)
+	child.SetAttr("warnings", 2)
+	child.End(errors.New("esbuild: oops"))
+	child.End(nil)
+	root.End(nil)
+
+	// the build task carries the trace context to the queue
+	task := &BuildTask{traceparent: root.Context().traceparent()}
+	if sc, ok := parseTraceparent(task.traceparent); !ok || sc.traceID != parent.traceID {
+		t.Fatalf("unexpected traceparent '%s'", task.traceparent)
+	}
+
+	tracer.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the spans to be exported")
+	}
+
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	esbuild, build := spans[0], spans[1]
+	if build.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || build.ParentSpanID != "00f067aa0ba902b7" || build.Status.Code != 0 {
+		t.Fatalf("unexpected build span: %+v", build)
+	}
+	if esbuild.TraceID != build.TraceID || esbuild.ParentSpanID != build.SpanID || esbuild.Status.Code != 2 || esbuild.Status.Message != "esbuild: oops" {
+		t.Fatalf("unexpected esbuild span: %+v", esbuild)
+	}
+	if len(esbuild.Attributes) != 2 || esbuild.Attributes[0].Key != "bundle" || *esbuild.Attributes[0].Value.BoolValue != true || *esbuild.Attributes[1].Value.IntValue != "2" {
+		t.Fatalf("unexpected attributes: %+v", esbuild.Attributes)
+	}
+	if name := received.ResourceSpans[0].Resource.Attributes[0]; name.Key != "service.name" || *name.Value.StringValue != "esm.sh" {
+		t.Fatalf("unexpected resource: %+v", received.ResourceSpans[0].Resource)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data otlpTracesData
+	if err := json.Unmarshal(line, &data); err != nil || len(data.ResourceSpans[0].ScopeSpans[0].Spans) != 2 {
+		t.Fatalf("unexpected line of the trace file: %s", line)
+	}
+	if _, err := r.ReadBytes('\n'); err != io.EOF {
+		t.Fatal("expected one line in the trace file")
+	}
+
+	// the spans are dropped after the tracer is closed
+	_, span := startRootSpan(context.Background(), spanContext{}, "build", spanKindInternal)
+	span.End(nil)
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
@@ -144,6 +146,38 @@ func ensureDir(dir string) (err error) {
 	return
 }
 
+// touchDir updates the modification time of the directory if it exists.
+func touchDir(dir string) {
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+}
+
+// dirSize returns the total size of the files in the directory, the symlinks are not followed.
+func dirSize(dir string) (size int64) {
+	filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func findFiles(root string, dir string, fn func(p string) bool) ([]string, error) {
 	rootDir, err := filepath.Abs(root)
 	if err != nil {
@@ -241,6 +275,12 @@ func concatBytes(a, b []byte) []byte {
 	return c
 }
 
+// checksumOf returns the hex encoded sha256 checksum of the data.
+func checksumOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 func jsDataUrl(code string) string {
 	return fmt.Sprintf("data:text/javascript;base64,%s", base64.StdEncoding.EncodeToString([]byte(code)))
 }
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+// The protocol of the remote build workers, all the endpoints require the auth secret:
+//   - `POST /_worker/lease` long-polls a task, responds 204 if there is no task in the wait time
+//   - `POST /_worker/heartbeat` extends the leases, responds the leases to cancel
+//   - `POST /_worker/report` reports the result of a leased task
+//
+// A leased task is requeued if the worker doesn't send heartbeat in the lease ttl.
+
+// the max time of a lease request waiting for a task
+const workerLeaseWait = 30 * time.Second
+
+var errLeaseNotFound = errors.New("lease not found")
+
+type workerLeaseRequest struct {
+	Worker string `json:"worker"`
+}
+
+type workerLeaseResponse struct {
+	Lease string      `json:"lease"`
+	TTL   int64       `json:"ttl"` // in seconds
+	Task  queueRecord `json:"task"`
+}
+
+type workerHeartbeat struct {
+	Worker string   `json:"worker"`
+	Leases []string `json:"leases"`
+	// the build stages of the leases
+	Stages map[string]string `json:"stages,omitempty"`
+}
+
+type workerHeartbeatResponse struct {
+	// the leases that are cancelled or expired, the worker should stop the builds
+	Cancel []string `json:"cancel"`
+}
+
+type workerReport struct {
+	Worker string    `json:"worker"`
+	Lease  string    `json:"lease"`
+	Meta   *ESMBuild `json:"meta,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	// the error is transient, it's nil if the worker doesn't report the flag
+	Transient *bool `json:"transient,omitempty"`
+}
+
+// output returns the build output of the report, the error is transient if it's flagged by the
+// worker, or it looks like a transient error if the worker doesn't report the flag.
+func (r *workerReport) output() BuildOutput {
+	output := BuildOutput{meta: r.Meta}
+	if r.Error != "" {
+		output.err = errors.New(r.Error)
+		if r.Transient != nil && *r.Transient || r.Transient == nil && isTransientErrorText(r.Error) {
+			output.err = asTransientError(output.err)
+		}
+	} else if r.Meta == nil {
+		output.err = errors.New("missing build meta")
+	}
+	return output
+}
+
+type workerLease struct {
+	id        string
+	worker    string
+	task      *queueTask
+	expiresAt time.Time
+	done      chan BuildOutput
+}
+
+// notifyWorkers wakes up the workers waiting for tasks.
+func (q *BuildQueue) notifyWorkers() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	close(q.pending)
+	q.pending = make(chan struct{})
+}
+
+// LeaseTask leases a pending task to the worker, it returns nil if there is no pending task.
+func (q *BuildQueue) LeaseTask(worker string, ttl time.Duration) *workerLease {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.workers[worker] = time.Now()
+	t, owner := q.pick(true)
+	if t == nil {
+		return nil
+	}
+	t.inProcess = true
+	t.owner = owner
+	t.worker = worker
+	t.startedAt = time.Now()
+	q.persist(t)
+	q.processes = append(q.processes, t)
+
+	l := &workerLease{
+		id:        newLeaseID(),
+		worker:    worker,
+		task:      t,
+		expiresAt: time.Now().Add(ttl),
+		done:      make(chan BuildOutput, 1),
+	}
+	q.leases[l.id] = l
+	metricQueueWait.ObserveSince(t.createdAt, t.priority().String())
+	q.emit(t, BuildEvent{
+		Type:     buildEventStarted,
+		Priority: t.priority().String(),
+		Worker:   worker,
+		Duration: time.Since(t.createdAt).Milliseconds(),
+	})
+	go q.waitLease(l)
+	return l
+}
+
+// Heartbeat extends the leases of the worker and updates the stages of the leased tasks, it returns
+// the leases that are cancelled or not found.
+func (q *BuildQueue) Heartbeat(worker string, leases []string, stages map[string]string, ttl time.Duration) (cancel []string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.workers[worker] = time.Now()
+	cancel = []string{}
+	for _, id := range leases {
+		l, ok := q.leases[id]
+		if !ok || l.worker != worker || l.task.context().Err() != nil {
+			cancel = append(cancel, id)
+			continue
+		}
+		l.expiresAt = time.Now().Add(ttl)
+		if stage, ok := stages[id]; ok && l.task.swapStage(stage) != stage {
+			q.emit(l.task, BuildEvent{Type: buildEventStage, Stage: stage, Worker: worker})
+		}
+	}
+	return
+}
+
+// Report completes the leased task with the output.
+func (q *BuildQueue) Report(worker string, lease string, output BuildOutput) error {
+	q.lock.Lock()
+	l, ok := q.leases[lease]
+	if ok && l.worker == worker {
+		delete(q.leases, lease)
+	}
+	q.lock.Unlock()
+
+	if !ok || l.worker != worker {
+		return errLeaseNotFound
+	}
+	l.done <- output
+	return nil
+}
+
+// waitLease waits for the report of the leased task, the task is requeued if the lease expires.
+func (q *BuildQueue) waitLease(l *workerLease) {
+	t := l.task
+	for {
+		q.lock.RLock()
+		expiresAt := l.expiresAt
+		q.lock.RUnlock()
+
+		select {
+		case output := <-l.done:
+			if output.err == nil {
+				log.Infof("build '%s' done by worker '%s' in %v", t.ID(), l.worker, time.Since(t.startedAt))
+			} else {
+				log.Errorf("build '%s' by worker '%s': %v", t.ID(), l.worker, output.err)
+			}
+			q.finish(t, output)
+			return
+		case <-time.After(time.Until(expiresAt)):
+		}
+
+		q.lock.Lock()
+		if time.Now().Before(l.expiresAt) {
+			// the lease is extended by the heartbeat
+			q.lock.Unlock()
+			continue
+		}
+		if _, ok := q.leases[l.id]; !ok {
+			// the report is received right now
+			q.lock.Unlock()
+			continue
+		}
+		delete(q.leases, l.id)
+		if err := t.context().Err(); err != nil {
+			q.lock.Unlock()
+			q.finish(t, BuildOutput{err: err})
+			return
+		}
+		a := make([]*queueTask, 0, len(q.processes))
+		for _, _t := range q.processes {
+			if _t != t {
+				a = append(a, _t)
+			}
+		}
+		q.processes = a
+		t.inProcess = false
+		t.owner = ""
+		t.worker = ""
+		t.startedAt = time.Time{}
+		q.persist(t)
+		q.lock.Unlock()
+
+		log.Warnf("build '%s': the lease of worker '%s' is expired, requeued", t.ID(), l.worker)
+		q.next()
+		q.notifyWorkers()
+		return
+	}
+}
+
+// waitPending returns a channel that is closed when there are new pending tasks.
+func (q *BuildQueue) waitPending() <-chan struct{} {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.pending
+}
+
+// Workers returns the workers that are seen in the ttl.
+func (q *BuildQueue) Workers(ttl time.Duration) []map[string]interface{} {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	leases := map[string]int{}
+	for _, l := range q.leases {
+		leases[l.worker]++
+	}
+	names := make([]string, 0, len(q.workers))
+	for name, lastSeen := range q.workers {
+		if time.Since(lastSeen) > ttl {
+			delete(q.workers, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	workers := make([]map[string]interface{}, len(names))
+	for i, name := range names {
+		workers[i] = map[string]interface{}{
+			"name":     name,
+			"lastSeen": q.workers[name].Format(http.TimeFormat),
+			"leases":   leases[name],
+		}
+	}
+	return workers
+}
+
+func newLeaseID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// workerHandler handles the requests of the remote build workers.
+func workerHandler(ctx *rex.Context) interface{} {
+	ttl := time.Duration(cfg.Workers.LeaseTTL)
+	body := io.LimitReader(ctx.R.Body, 1024*1024)
+	defer ctx.R.Body.Close()
+
+	switch ctx.Path.String() {
+	case "/_worker/lease":
+		var req workerLeaseRequest
+		if json.NewDecoder(body).Decode(&req) != nil || req.Worker == "" {
+			return rex.Err(400, "require valid json body")
+		}
+		timer := time.NewTimer(workerLeaseWait)
+		defer timer.Stop()
+		for {
+			// get the notify channel before leasing to not miss the new tasks
+			pending := buildQueue.waitPending()
+			if l := buildQueue.LeaseTask(req.Worker, ttl); l != nil {
+				return workerLeaseResponse{
+					Lease: l.id,
+					TTL:   int64(ttl.Seconds()),
+					Task:  newQueueRecord(l.task),
+				}
+			}
+			select {
+			case <-pending:
+			case <-timer.C:
+				return rex.Status(http.StatusNoContent, "")
+			case <-ctx.R.Context().Done():
+				return rex.Status(http.StatusNoContent, "")
+			}
+		}
+
+	case "/_worker/heartbeat":
+		var req workerHeartbeat
+		if json.NewDecoder(body).Decode(&req) != nil || req.Worker == "" {
+			return rex.Err(400, "require valid json body")
+		}
+		return workerHeartbeatResponse{
+			Cancel: buildQueue.Heartbeat(req.Worker, req.Leases, req.Stages, ttl),
+		}
+
+	case "/_worker/report":
+		var req workerReport
+		if json.NewDecoder(body).Decode(&req) != nil || req.Worker == "" || req.Lease == "" {
+			return rex.Err(400, "require valid json body")
+		}
+		if err := buildQueue.Report(req.Worker, req.Lease, req.output()); err != nil {
+			return rex.Err(http.StatusGone, err.Error())
+		}
+		return map[string]interface{}{"ok": true}
+
+	default:
+		return rex.Err(404, "not found")
+	}
+}
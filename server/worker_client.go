@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildWorker pulls the build tasks from the coordinator server and runs them, the builds are
+// written to the shared storage.
+type buildWorker struct {
+	name        string
+	coordinator string
+	secret      string
+	client      *http.Client
+	lock        sync.Mutex
+	running     map[string]*queueTask
+	heartbeat   time.Duration
+}
+
+func newBuildWorker(coordinator string, secret string) *buildWorker {
+	hostname, _ := os.Hostname()
+	return &buildWorker{
+		name:        fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		coordinator: strings.TrimRight(coordinator, "/"),
+		secret:      secret,
+		client:      &http.Client{Timeout: workerLeaseWait + 30*time.Second},
+		running:     map[string]*queueTask{},
+		heartbeat:   10 * time.Second,
+	}
+}
+
+// Run runs the worker with the concurrency until the context is done.
+func (w *buildWorker) Run(ctx context.Context, concurrency int) {
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx)
+		}()
+	}
+	go w.keepAlive(ctx)
+	log.Infof("worker '%s' is pulling tasks from %s", w.name, w.coordinator)
+	wg.Wait()
+}
+
+func (w *buildWorker) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		var lease workerLeaseResponse
+		status, err := w.post(ctx, "/_worker/lease", workerLeaseRequest{Worker: w.name}, &lease)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("worker: lease: %v", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(5 * time.Second):
+				}
+			}
+			continue
+		}
+		if status == http.StatusNoContent {
+			continue
+		}
+		if lease.TTL > 0 {
+			w.lock.Lock()
+			if d := time.Duration(lease.TTL) * time.Second / 3; d < w.heartbeat {
+				w.heartbeat = d
+			}
+			w.lock.Unlock()
+		}
+		w.run(lease)
+	}
+}
+
+// run runs the leased task and reports the output, the build is cancelled if the coordinator
+// cancels the lease.
+func (w *buildWorker) run(lease workerLeaseResponse) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	task := lease.Task.task()
+	task.ctx = ctx
+	task.stage = "pending"
+	t := &queueTask{BuildTask: task, startedAt: time.Now(), cancel: cancel}
+
+	w.lock.Lock()
+	w.running[lease.Lease] = t
+	w.lock.Unlock()
+
+	output := t.run()
+
+	w.lock.Lock()
+	delete(w.running, lease.Lease)
+	w.lock.Unlock()
+
+	report := workerReport{Worker: w.name, Lease: lease.Lease, Meta: output.meta}
+	if output.err != nil {
+		transient := isTransientError(output.err)
+		report.Error = output.err.Error()
+		report.Transient = &transient
+		report.Meta = nil
+	}
+	// the report must be delivered even if the worker is shutting down
+	status, err := w.post(context.Background(), "/_worker/report", report, nil)
+	if err == nil && status == http.StatusGone {
+		log.Warnf("worker: the lease of '%s' is expired", task.ID())
+	} else if err != nil {
+		log.Errorf("worker: report: %v", err)
+	}
+}
+
+// keepAlive sends the heartbeat of the running leases, and cancels the leases that the
+// coordinator doesn't hold any more.
+func (w *buildWorker) keepAlive(ctx context.Context) {
+	for {
+		w.lock.Lock()
+		interval := w.heartbeat
+		leases := make([]string, 0, len(w.running))
+		stages := make(map[string]string, len(w.running))
+		for id, t := range w.running {
+			leases = append(leases, id)
+			stages[id] = t.getStage()
+		}
+		w.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		// the heartbeat without leases keeps the worker registered
+		var ret workerHeartbeatResponse
+		_, err := w.post(ctx, "/_worker/heartbeat", workerHeartbeat{Worker: w.name, Leases: leases, Stages: stages}, &ret)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("worker: heartbeat: %v", err)
+			}
+			continue
+		}
+		w.lock.Lock()
+		for _, id := range ret.Cancel {
+			if t, ok := w.running[id]; ok {
+				t.cancel()
+			}
+		}
+		w.lock.Unlock()
+	}
+}
+
+func (w *buildWorker) post(ctx context.Context, path string, body interface{}, ret interface{}) (status int, err error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.coordinator+path, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+w.secret)
+	res, err := w.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	status = res.StatusCode
+	if status == http.StatusNoContent || status == http.StatusGone {
+		return
+	}
+	if status != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return status, fmt.Errorf("<%d> %s", status, strings.TrimSpace(string(msg)))
+	}
+	if ret != nil {
+		err = json.NewDecoder(res.Body).Decode(ret)
+	}
+	return
+}
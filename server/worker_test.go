@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestWorkerLease(t *testing.T) {
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{FinishThreshold: 0.8}, nil)
+	newTask := func(name string, target string) *BuildTask {
+		return &BuildTask{Pkg: Pkg{Name: name, Version: "1.0.0"}, id: name, Target: target}
+	}
+
+	if l := q.LeaseTask("w1", time.Minute); l != nil {
+		t.Fatal("expected no task to lease")
+	}
+
+	pending := q.waitPending()
+	c, _ := q.Add(newTask("a", "es2022"), BuildClient{IP: "127.0.0.1"})
+	q.Add(newTask("raw", "raw"), BuildClient{IP: "127.0.0.1"})
+	select {
+	case <-pending:
+	default:
+		t.Fatal("the workers should be notified")
+	}
+
+	l := q.LeaseTask("w1", time.Minute)
+	if l == nil || l.task.ID() != "a" || l.task.worker != "w1" {
+		t.Fatal("expected to lease task 'a'")
+	}
+	// the raw installs are not leased to the workers
+	if l := q.LeaseTask("w1", time.Minute); l != nil {
+		t.Fatalf("expected no task to lease, got %s", l.task.ID())
+	}
+
+	if cancel := q.Heartbeat("w1", []string{l.id, "unknown"}, map[string]string{l.id: "build"}, time.Minute); len(cancel) != 1 || cancel[0] != "unknown" {
+		t.Fatalf("unexpected cancelled leases: %v", cancel)
+	}
+	if l.task.stage != "build" {
+		t.Fatalf("expected the stage to be updated by the heartbeat, got '%s'", l.task.stage)
+	}
+	if err := q.Report("w2", l.id, BuildOutput{}); err != errLeaseNotFound {
+		t.Fatal("the lease of other worker should not be reported")
+	}
+	if err := q.Report("w1", l.id, BuildOutput{meta: &ESMBuild{HasExportDefault: true}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case output := <-c.C:
+		if output.err != nil || !output.meta.HasExportDefault {
+			t.Fatal("unexpected output")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the consumer should receive the output")
+	}
+	if q.Len() != 1 {
+		t.Fatalf("expected 1 task in the queue, got %d", q.Len())
+	}
+	if workers := q.Workers(time.Minute); len(workers) != 1 || workers[0]["name"] != "w1" {
+		t.Fatalf("unexpected workers: %v", workers)
+	}
+}
+
+func TestWorkerLeaseExpiry(t *testing.T) {
+	q := newBuildQueue(0, config.BuildLimits{}, config.BuildCancel{FinishThreshold: 0.8}, nil)
+	task := &BuildTask{Pkg: Pkg{Name: "a", Version: "1.0.0"}, id: "a", Target: "es2022"}
+	c, _ := q.Add(task, BuildClient{IP: "127.0.0.1"})
+
+	l := q.LeaseTask("w1", 50*time.Millisecond)
+	if l == nil {
+		t.Fatal("expected to lease a task")
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// the expired task is requeued
+	if err := q.Report("w1", l.id, BuildOutput{}); err != errLeaseNotFound {
+		t.Fatal("the expired lease should not be reported")
+	}
+	l2 := q.LeaseTask("w2", time.Minute)
+	if l2 == nil || l2.task != l.task {
+		t.Fatal("the expired task should be leased again")
+	}
+
+	// the cancelled task is reported to the worker by the heartbeat
+	q.RemoveConsumer(task, c)
+	if cancel := q.Heartbeat("w2", []string{l2.id}, nil, time.Minute); len(cancel) != 1 {
+		t.Fatal("the cancelled lease should be reported")
+	}
+	q.Report("w2", l2.id, BuildOutput{err: errors.New("cancelled")})
+	time.Sleep(50 * time.Millisecond)
+	if q.Len() != 0 {
+		t.Fatalf("expected empty queue, got %d", q.Len())
+	}
+}